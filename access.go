@@ -0,0 +1,256 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// AccessActions of access rules
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessControl checks requests of clients before response is created
+type AccessControl interface {
+	// Check if client can send request, ErrorHandler with exception code is returned if it is denied
+	CheckAccess(addr net.Addr, aduUnit *ADUUnit) (errHandler ErrorHandler)
+}
+
+// AccessRule for clients from network, empty array matches all unit IDs (function codes, registers)
+type AccessRule struct {
+	// Network of clients, i.e. "192.168.1.0/24" (empty matches all clients)
+	CIDR string
+	// Allow or deny request, see @AccessAction consts
+	Action        string
+	UnitIDs       []int
+	FunctionCodes []int
+	// Ranges of register (coil) addresses [first, last], allowed request must be inside, denied request overlaps
+	Registers [][2]int
+	// Data blocks accessed by request (see @DataBlock consts), it qualifies Registers (ranges apply to all data blocks if it is empty)
+	DataBlocks []int
+}
+
+// AccessJSON is part of config file with access control, see @conf.json.comment
+type AccessJSON struct {
+	// Rules are checked in order, first matching rule is applied
+	AccessRules []AccessRule
+	// Action if no rule matches, deny by default if there are any rules
+	AccessDefault string
+}
+
+// accessRule is parsed AccessRule
+type accessRule struct {
+	AccessRule
+	network *net.IPNet
+}
+
+type accessControl struct {
+	rules         []accessRule
+	defaultAction string
+}
+
+// NewAccessControl creates access control according to "AccessRules" in config file, all requests are allowed if there are no rules
+func NewAccessControl(config string) (AccessControl, error) {
+
+	file, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mapp AccessJSON
+	if err = json.NewDecoder(file).Decode(&mapp); err != nil {
+		return nil, err
+	}
+
+	ac := &accessControl{defaultAction: mapp.AccessDefault}
+	if ac.defaultAction == "" {
+		ac.defaultAction = AccessDeny
+		if len(mapp.AccessRules) == 0 {
+			ac.defaultAction = AccessAllow
+		}
+	}
+	if ac.defaultAction != AccessAllow && ac.defaultAction != AccessDeny {
+		return nil, fmt.Errorf("modbus: invalid AccessDefault %q", mapp.AccessDefault)
+	}
+
+	for i, rule := range mapp.AccessRules {
+		if rule.Action != AccessAllow && rule.Action != AccessDeny {
+			return nil, fmt.Errorf("modbus: invalid Action %q of AccessRules[%d]", rule.Action, i)
+		}
+		for _, r := range rule.Registers {
+			if r[0] > r[1] {
+				return nil, fmt.Errorf("modbus: invalid register range %v of AccessRules[%d]", r, i)
+			}
+		}
+		for _, dataBlock := range rule.DataBlocks {
+			if dataBlock < DataBlockHoldingRegisters || dataBlock > DataBlockDiscreteInputs {
+				return nil, fmt.Errorf("modbus: invalid data block %d of AccessRules[%d]", dataBlock, i)
+			}
+		}
+
+		parsed := accessRule{AccessRule: rule}
+		if rule.CIDR != "" {
+			_, parsed.network, err = net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("modbus: invalid CIDR of AccessRules[%d]: %v", i, err)
+			}
+		}
+		ac.rules = append(ac.rules, parsed)
+	}
+
+	return ac, nil
+}
+
+/**
+* CheckAccess applies first rule matching client and request
+* @return errHandler ErrorHandler IllegalDataAddress if denying rule specifies registers, IllegalFunction otherwise
+ */
+func (ac *accessControl) CheckAccess(addr net.Addr, aduUnit *ADUUnit) (errHandler ErrorHandler) {
+
+	ip := addrIP(addr)
+	ranges := requestRanges(aduUnit)
+
+	action := ac.defaultAction
+	var matched *accessRule
+	for i := range ac.rules {
+		if ac.rules[i].matches(ip, aduUnit, ranges) {
+			matched = &ac.rules[i]
+			action = matched.Action
+			break
+		}
+	}
+
+	if action == AccessAllow {
+		return errHandler
+	}
+
+	errHandler.FunctionCode = aduUnit.functionCode
+	errHandler.ExceptionCode = ExceptionCodeIllegalFunction
+	if matched != nil && len(matched.Registers) > 0 {
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+	}
+	return errHandler
+}
+
+// matches checks if rule applies to client and request
+func (r *accessRule) matches(ip net.IP, aduUnit *ADUUnit, ranges [][2]int) bool {
+
+	if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+		return false
+	}
+	if !containsInt(r.UnitIDs, int(aduUnit.unitID)) || !containsInt(r.FunctionCodes, int(aduUnit.functionCode)) {
+		return false
+	}
+	// Request without data block (unknown function code) does not match
+	if len(r.DataBlocks) > 0 {
+		dataBlock, flag := requestDataBlock(aduUnit.functionCode)
+		if flag == false || !containsInt(r.DataBlocks, dataBlock) {
+			return false
+		}
+	}
+	if len(r.Registers) == 0 {
+		return true
+	}
+	// Request without registers (or invalid one) does not match
+	if len(ranges) == 0 {
+		return false
+	}
+
+	for _, req := range ranges {
+		inside, overlaps := false, false
+		for _, reg := range r.Registers {
+			if req[0] >= reg[0] && req[1] <= reg[1] {
+				inside = true
+			}
+			if req[0] <= reg[1] && req[1] >= reg[0] {
+				overlaps = true
+			}
+		}
+		if r.Action == AccessAllow && !inside {
+			return false
+		}
+		if r.Action == AccessDeny && overlaps {
+			return true
+		}
+	}
+	return r.Action == AccessAllow
+}
+
+// requestRanges gets ranges of register (coil) addresses [first, last] accessed by request
+func requestRanges(aduUnit *ADUUnit) (ranges [][2]int) {
+
+	data := aduUnit.data
+	if len(data) < 4 {
+		return nil
+	}
+	addr := int(binary.BigEndian.Uint16(data))
+
+	switch aduUnit.functionCode {
+	case FuncCodeWriteSingleCoil, FuncCodeWriteSingleRegister:
+		return [][2]int{{addr, addr}}
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs, FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters,
+		FuncCodeWriteMultipleCoils, FuncCodeWriteMultipleRegisters, FuncCodeReadWriteMultipleRegisters:
+		quantity := int(binary.BigEndian.Uint16(data[2:]))
+		if quantity == 0 {
+			return nil
+		}
+		ranges = append(ranges, [2]int{addr, addr + quantity - 1})
+	default:
+		return nil
+	}
+
+	// Write part of read/write request
+	if aduUnit.functionCode == FuncCodeReadWriteMultipleRegisters {
+		if len(data) < 8 {
+			return nil
+		}
+		addr = int(binary.BigEndian.Uint16(data[4:]))
+		quantity := int(binary.BigEndian.Uint16(data[6:]))
+		if quantity == 0 {
+			return nil
+		}
+		ranges = append(ranges, [2]int{addr, addr + quantity - 1})
+	}
+
+	return ranges
+}
+
+// requestDataBlock gets data block accessed by function code, see @DataBlock consts
+func requestDataBlock(functionCode byte) (dataBlock int, flag bool) {
+	switch functionCode {
+	case FuncCodeReadCoils, FuncCodeWriteSingleCoil, FuncCodeWriteMultipleCoils:
+		return DataBlockCoils, true
+	case FuncCodeReadDiscreteInputs:
+		return DataBlockDiscreteInputs, true
+	case FuncCodeReadInputRegisters:
+		return DataBlockInputRegisters, true
+	case FuncCodeReadHoldingRegisters, FuncCodeWriteSingleRegister, FuncCodeWriteMultipleRegisters, FuncCodeReadWriteMultipleRegisters:
+		return DataBlockHoldingRegisters, true
+	}
+	return 0, false
+}
+
+// addrIP gets IP address of client
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// SetAccessControl sets access control of clients, nil allows all requests
+func (s *server) SetAccessControl(ac AccessControl) {
+	s.access = ac
+}
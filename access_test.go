@@ -0,0 +1,60 @@
+package modbus
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAccessControl(t *testing.T, config string) (AccessControl, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return NewAccessControl(path)
+}
+
+func TestAccessRuleDataBlocks(t *testing.T) {
+	ac, err := newTestAccessControl(t, `{
+		"AccessRules": [
+			{"Action": "deny", "DataBlocks": [1], "Registers": [[100, 199]]},
+			{"Action": "deny", "DataBlocks": [2, 3], "FunctionCodes": [5, 15]},
+			{"Action": "allow"}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	tests := []struct {
+		name          string
+		functionCode  byte
+		data          []byte
+		exceptionCode byte
+	}{
+		{"input registers in range", FuncCodeReadInputRegisters, []byte{0, 150, 0, 2}, ExceptionCodeIllegalDataAddress},
+		{"input registers out of range", FuncCodeReadInputRegisters, []byte{0, 200, 0, 2}, ExceptionCodeSuccess},
+		{"holding registers in range", FuncCodeReadHoldingRegisters, []byte{0, 150, 0, 2}, ExceptionCodeSuccess},
+		{"write holding register in range", FuncCodeWriteSingleRegister, []byte{0, 150, 0, 1}, ExceptionCodeSuccess},
+		{"read coils", FuncCodeReadCoils, []byte{0, 150, 0, 1}, ExceptionCodeSuccess},
+		{"write coil", FuncCodeWriteSingleCoil, []byte{0, 150, 0xFF, 0}, ExceptionCodeIllegalFunction},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errHandler := ac.CheckAccess(addr, &ADUUnit{unitID: 1, functionCode: test.functionCode, data: test.data})
+			if errHandler.ExceptionCode != test.exceptionCode {
+				t.Errorf("exception code %d, want %d", errHandler.ExceptionCode, test.exceptionCode)
+			}
+		})
+	}
+}
+
+func TestAccessRuleInvalidDataBlock(t *testing.T) {
+	if _, err := newTestAccessControl(t, `{"AccessRules": [{"Action": "deny", "DataBlocks": [4]}]}`); err == nil {
+		t.Error("invalid data block accepted")
+	}
+}
@@ -0,0 +1,82 @@
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// MaxASCIILineLength - ":" + hex of unit ID, PDU and LRC (2 x 255B) + CRLF
+const MaxASCIILineLength = 1 + 2*255 + 2
+
+// lrc computes modbus ASCII LRC (two's complement of sum of bytes)
+func lrc(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// asciiFramer splits stream to modbus ASCII frames (":" + hex + LRC + CRLF), implements Framer interface
+type asciiFramer struct {
+	r      *bufio.Reader
+	w      io.Writer
+	logger Logger
+}
+
+// NewASCIIFramer creates framer for modbus ASCII stream
+func NewASCIIFramer(rw io.ReadWriter) Framer {
+	return newASCIIFramer(rw, defaultLogger)
+}
+
+func newASCIIFramer(rw io.ReadWriter, logger Logger) *asciiFramer {
+	return &asciiFramer{r: bufio.NewReaderSize(rw, MaxASCIILineLength), w: rw, logger: logger}
+}
+
+/**
+* ReadADU reads line ended by LF and decodes frame started by ":", invalid frames are dropped
+* @return adu []byte whole ADU (MBAP with transaction ID 0 + PDU)
+ */
+func (f *asciiFramer) ReadADU() (adu []byte, err error) {
+
+	for {
+		line, err := f.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, ErrFrameLength
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Frame starts by last ":" (garbage before it is ignored)
+		start := bytes.LastIndexByte(line, ':')
+		if start < 0 {
+			f.logger.Warn("Dropping ASCII line without start of frame", F("line", string(line)))
+			continue
+		}
+
+		// unit ID (1B) + function code (1B) + LRC (1B)
+		frame, err := hex.DecodeString(strings.TrimRight(string(line[start+1:]), "\r\n"))
+		if err != nil || len(frame) < 3 || lrc(frame) != 0 {
+			f.logger.Warn("Dropping invalid ASCII frame", F("line", string(line)))
+			continue
+		}
+
+		return pduToADU(frame[:len(frame)-1]), nil
+	}
+}
+
+// WriteADU writes ADU as ASCII frame, nothing is written for broadcast requests (unit ID 0)
+func (f *asciiFramer) WriteADU(adu []byte) (err error) {
+	if adu[6] == 0 {
+		return nil
+	}
+
+	pdu := adu[6:]
+	frame := ":" + strings.ToUpper(hex.EncodeToString(append(pdu[:len(pdu):len(pdu)], lrc(pdu)))) + "\r\n"
+	_, err = io.WriteString(f.w, frame)
+	return err
+}
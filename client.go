@@ -0,0 +1,429 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultClientTimeout of client requests
+const DefaultClientTimeout = time.Second
+
+// ErrInvalidResponse is returned by client if response does not match request
+var ErrInvalidResponse = errors.New("modbus: invalid response")
+
+// Error describes exception, ErrorHandler is returned by client for exception responses
+func (errHandler ErrorHandler) Error() string {
+	return fmt.Sprintf("modbus: exception %d (function code %d)", errHandler.ExceptionCode, errHandler.FunctionCode)
+}
+
+// Client is modbus TCP master, requests are sent one by one, connection is (re)opened by next request after any error
+type Client interface {
+	// Open connection (it is opened by first request too)
+	Connect() (err error)
+
+	// Close connection
+	Close() (err error)
+
+	// Set timeout of request (connecting, sending request and receiving response)
+	SetTimeout(timeout time.Duration)
+
+	// Set logger, see @Logger
+	SetLogger(logger Logger)
+
+	ReadCoils(unitID byte, addr uint16, quantity uint16) (values []bool, err error)
+	ReadDiscreteInputs(unitID byte, addr uint16, quantity uint16) (values []bool, err error)
+	ReadHoldingRegisters(unitID byte, addr uint16, quantity uint16) (regs []uint16, err error)
+	ReadInputRegisters(unitID byte, addr uint16, quantity uint16) (regs []uint16, err error)
+	WriteSingleCoil(unitID byte, addr uint16, value bool) (err error)
+	WriteSingleRegister(unitID byte, addr uint16, value uint16) (err error)
+	WriteMultipleCoils(unitID byte, addr uint16, values []bool) (err error)
+	WriteMultipleRegisters(unitID byte, addr uint16, regs []uint16) (err error)
+	ReadWriteMultipleRegisters(unitID byte, readAddr uint16, readQuantity uint16, writeAddr uint16, regs []uint16) (readRegs []uint16, err error)
+
+	// Send request with any function code and data, data of response is returned (it is used by gateway)
+	Send(unitID byte, functionCode byte, data []byte) (response []byte, err error)
+}
+
+type client struct {
+	addr    string
+	port    int
+	timeout time.Duration
+	logger  Logger
+
+	// Requests are serialized, connection and transaction ID are guarded by mutex
+	mu            sync.Mutex
+	conn          net.Conn
+	framer        Framer
+	transactionID uint16
+
+	// Framer of serial line for RTU client, nil for TCP client
+	rtu *rtuFramer
+}
+
+// NewTCPClient creates modbus TCP client of device on address and port
+func NewTCPClient(addr string, port int) Client {
+	return &client{addr: addr, port: port, timeout: DefaultClientTimeout, logger: defaultLogger}
+}
+
+// NewRTUClient creates modbus RTU master on serial line port (any io.ReadWriter, ie. opened tty), it is shared by all devices on the line, broadcast (unit ID 0) is not supported
+func NewRTUClient(port io.ReadWriter, baudRate int) Client {
+	rtu := newRTUFramer(port, baudRate, defaultLogger)
+	return &client{timeout: DefaultClientTimeout, logger: defaultLogger, framer: rtu, rtu: rtu}
+}
+
+func (cl *client) SetTimeout(timeout time.Duration) {
+	cl.timeout = timeout
+}
+
+func (cl *client) SetLogger(logger Logger) {
+	cl.logger = logger
+	if cl.rtu != nil {
+		cl.rtu.logger = logger
+	}
+}
+
+func (cl *client) Connect() (err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.connect()
+}
+
+// connect opens connection if it is not open (serial line is always open), it must be called with locked mutex
+func (cl *client) connect() (err error) {
+	if cl.conn != nil || cl.rtu != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", cl.addr+":"+strconv.Itoa(cl.port), cl.timeout)
+	if err != nil {
+		cl.logger.Warn("Not possible to connect to device", F("addr", cl.addr), F("port", cl.port), F("error", err))
+		return err
+	}
+
+	cl.logger.Debug("Connected to device", F("remote", conn.RemoteAddr()))
+	cl.conn = conn
+	cl.framer = NewMBAPFramer(conn)
+	return nil
+}
+
+func (cl *client) Close() (err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.close()
+}
+
+// close closes connection, it must be called with locked mutex
+func (cl *client) close() (err error) {
+	if cl.conn == nil {
+		return nil
+	}
+	err = cl.conn.Close()
+	cl.conn = nil
+	cl.framer = nil
+	return err
+}
+
+/**
+* send sends request and waits for its response, responses of older (timed out) requests are skipped
+* @param unitID unit ID of device
+* @param functionCode function code of request
+* @param data data of request (after function code)
+* @return response ADUUnit response with data after function code, errHandler is returned as error for exception response
+ */
+func (cl *client) send(unitID byte, functionCode byte, data []byte) (response ADUUnit, err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if err = cl.connect(); err != nil {
+		return response, err
+	}
+
+	cl.transactionID++
+	request := ADUUnit{transactionID: cl.transactionID, unitID: unitID, functionCode: functionCode, data: data}
+	l := cl.logger.With(F("tid", request.transactionID), F("unit", unitID), F("fc", functionCode))
+
+	if cl.rtu != nil {
+		cl.rtu.readTimeout = cl.timeout
+	} else {
+		l = l.With(F("remote", cl.conn.RemoteAddr()))
+		cl.conn.SetDeadline(time.Now().Add(cl.timeout))
+	}
+	l.Debug("Sending request", F("data", data))
+	if err = cl.framer.WriteADU(request.encode()); err != nil {
+		l.Warn("Sending error", F("error", err))
+		cl.close()
+		return response, err
+	}
+
+	for {
+		adu, err := cl.framer.ReadADU()
+		if err != nil {
+			// Stream can not be synchronized again, connection is opened by next request
+			l.Warn("Read error", F("error", err))
+			cl.close()
+			return response, err
+		}
+
+		response = ADUUnit{transactionID: binary.BigEndian.Uint16(adu), protocolID: binary.BigEndian.Uint16(adu[2:]),
+			length: binary.BigEndian.Uint16(adu[4:]), unitID: adu[6], functionCode: adu[7], data: adu[8:]}
+		// RTU frames have no transaction ID
+		if cl.rtu != nil || response.transactionID == request.transactionID {
+			break
+		}
+		l.Debug("Skipping response of older request", F("response_tid", response.transactionID))
+	}
+
+	l.Debug("Received response", F("data", response.data))
+
+	if response.functionCode == functionCode|0x80 && len(response.data) == 1 {
+		return response, ErrorHandler{FunctionCode: functionCode, ExceptionCode: response.data[0]}
+	}
+	if response.functionCode != functionCode || response.unitID != unitID {
+		l.Warn("Response does not match request", F("response_unit", response.unitID), F("response_fc", response.functionCode))
+		return response, ErrInvalidResponse
+	}
+
+	return response, nil
+}
+
+// encode builds ADU (MBAP + PDU) from ADUUnit
+func (aduUnit *ADUUnit) encode() []byte {
+	adu := make([]byte, 8+len(aduUnit.data))
+	binary.BigEndian.PutUint16(adu, aduUnit.transactionID)
+	binary.BigEndian.PutUint16(adu[2:], aduUnit.protocolID)
+	binary.BigEndian.PutUint16(adu[4:], uint16(2+len(aduUnit.data)))
+	adu[6] = aduUnit.unitID
+	adu[7] = aduUnit.functionCode
+	copy(adu[8:], aduUnit.data)
+	return adu
+}
+
+// addrQuantity builds request data with address and quantity (value)
+func addrQuantity(addr uint16, quantity uint16) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, addr)
+	binary.BigEndian.PutUint16(data[2:], quantity)
+	return data
+}
+
+// readBits reads coils or discrete inputs
+func (cl *client) readBits(unitID byte, functionCode byte, addr uint16, quantity uint16) (values []bool, err error) {
+	if quantity < 1 || quantity > 2000 {
+		return nil, ErrorHandler{FunctionCode: functionCode, ExceptionCode: ExceptionCodeIllegalDataValue}
+	}
+
+	response, err := cl.send(unitID, functionCode, addrQuantity(addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	// Data = byte count (1B) + packed bits
+	byteCount := int(quantity+7) / 8
+	if len(response.data) != 1+byteCount || int(response.data[0]) != byteCount {
+		return nil, ErrInvalidResponse
+	}
+
+	values = make([]bool, quantity)
+	for i := range values {
+		values[i] = response.data[1+i/8]&(1<<uint(i%8)) != 0
+	}
+	return values, nil
+}
+
+// readRegisters reads holding or input registers
+func (cl *client) readRegisters(unitID byte, functionCode byte, data []byte, quantity uint16) (regs []uint16, err error) {
+	if quantity < 1 || quantity > 125 {
+		return nil, ErrorHandler{FunctionCode: functionCode, ExceptionCode: ExceptionCodeIllegalDataValue}
+	}
+
+	response, err := cl.send(unitID, functionCode, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data = byte count (1B) + registers
+	if len(response.data) != 1+int(quantity)*2 || int(response.data[0]) != int(quantity)*2 {
+		return nil, ErrInvalidResponse
+	}
+
+	regs = make([]uint16, quantity)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(response.data[1+i*2:])
+	}
+	return regs, nil
+}
+
+// checkEcho checks response of write request which echoes first 4 bytes of request data
+func checkEcho(response ADUUnit, data []byte) (err error) {
+	if len(response.data) != 4 || binary.BigEndian.Uint32(response.data) != binary.BigEndian.Uint32(data) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+func (cl *client) ReadCoils(unitID byte, addr uint16, quantity uint16) (values []bool, err error) {
+	return cl.readBits(unitID, FuncCodeReadCoils, addr, quantity)
+}
+
+func (cl *client) ReadDiscreteInputs(unitID byte, addr uint16, quantity uint16) (values []bool, err error) {
+	return cl.readBits(unitID, FuncCodeReadDiscreteInputs, addr, quantity)
+}
+
+func (cl *client) ReadHoldingRegisters(unitID byte, addr uint16, quantity uint16) (regs []uint16, err error) {
+	return cl.readRegisters(unitID, FuncCodeReadHoldingRegisters, addrQuantity(addr, quantity), quantity)
+}
+
+func (cl *client) ReadInputRegisters(unitID byte, addr uint16, quantity uint16) (regs []uint16, err error) {
+	return cl.readRegisters(unitID, FuncCodeReadInputRegisters, addrQuantity(addr, quantity), quantity)
+}
+
+func (cl *client) WriteSingleCoil(unitID byte, addr uint16, value bool) (err error) {
+	var coil uint16
+	if value {
+		coil = 0xFF00
+	}
+	data := addrQuantity(addr, coil)
+
+	response, err := cl.send(unitID, FuncCodeWriteSingleCoil, data)
+	if err != nil {
+		return err
+	}
+	return checkEcho(response, data)
+}
+
+func (cl *client) WriteSingleRegister(unitID byte, addr uint16, value uint16) (err error) {
+	data := addrQuantity(addr, value)
+
+	response, err := cl.send(unitID, FuncCodeWriteSingleRegister, data)
+	if err != nil {
+		return err
+	}
+	return checkEcho(response, data)
+}
+
+func (cl *client) WriteMultipleCoils(unitID byte, addr uint16, values []bool) (err error) {
+	if len(values) < 1 || len(values) > 1968 {
+		return ErrorHandler{FunctionCode: FuncCodeWriteMultipleCoils, ExceptionCode: ExceptionCodeIllegalDataValue}
+	}
+
+	// Data = address (2B) + quantity (2B) + byte count (1B) + packed values
+	byteCount := (len(values) + 7) / 8
+	data := append(addrQuantity(addr, uint16(len(values))), byte(byteCount))
+	data = append(data, make([]byte, byteCount)...)
+	for i, value := range values {
+		if value {
+			data[5+i/8] |= 1 << uint(i%8)
+		}
+	}
+
+	response, err := cl.send(unitID, FuncCodeWriteMultipleCoils, data)
+	if err != nil {
+		return err
+	}
+	return checkEcho(response, data)
+}
+
+func (cl *client) WriteMultipleRegisters(unitID byte, addr uint16, regs []uint16) (err error) {
+	if len(regs) < 1 || len(regs) > 123 {
+		return ErrorHandler{FunctionCode: FuncCodeWriteMultipleRegisters, ExceptionCode: ExceptionCodeIllegalDataValue}
+	}
+
+	// Data = address (2B) + quantity (2B) + byte count (1B) + registers
+	data := append(addrQuantity(addr, uint16(len(regs))), byte(len(regs)*2))
+	data = append(data, registersBytes(regs)...)
+
+	response, err := cl.send(unitID, FuncCodeWriteMultipleRegisters, data)
+	if err != nil {
+		return err
+	}
+	return checkEcho(response, data)
+}
+
+func (cl *client) ReadWriteMultipleRegisters(unitID byte, readAddr uint16, readQuantity uint16, writeAddr uint16, regs []uint16) (readRegs []uint16, err error) {
+	if len(regs) < 1 || len(regs) > 121 {
+		return nil, ErrorHandler{FunctionCode: FuncCodeReadWriteMultipleRegisters, ExceptionCode: ExceptionCodeIllegalDataValue}
+	}
+
+	// Data = read address (2B) + read quantity (2B) + write address (2B) + write quantity (2B) + byte count (1B) + registers
+	data := append(addrQuantity(readAddr, readQuantity), addrQuantity(writeAddr, uint16(len(regs)))...)
+	data = append(data, byte(len(regs)*2))
+	data = append(data, registersBytes(regs)...)
+
+	return cl.readRegisters(unitID, FuncCodeReadWriteMultipleRegisters, data, readQuantity)
+}
+
+func (cl *client) Send(unitID byte, functionCode byte, data []byte) (response []byte, err error) {
+	aduUnit, err := cl.send(unitID, functionCode, data)
+	if err != nil {
+		return nil, err
+	}
+	return aduUnit.data, nil
+}
+
+// registersBytes converts registers to bytes (big endian)
+func registersBytes(regs []uint16) []byte {
+	data := make([]byte, len(regs)*2)
+	for i, reg := range regs {
+		binary.BigEndian.PutUint16(data[i*2:], reg)
+	}
+	return data
+}
+
+// deviceClients creates clients of downstream devices (see @Poller and @Gateway), devices on the same serial line share one RTU client
+type deviceClients struct {
+	rtu   map[string]Client
+	ports []io.Closer
+}
+
+// client of device on address ("host:port", modbus TCP) or on serial line (modbus RTU), only one of them must be set
+func (dc *deviceClients) client(address string, serial string, baudRate int) (Client, error) {
+
+	switch {
+	case address != "" && serial == "":
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Address: %v", err)
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of Address: %v", err)
+		}
+		return NewTCPClient(host, portNum), nil
+	case serial != "" && address == "":
+		if cl, ok := dc.rtu[serial]; ok {
+			return cl, nil
+		}
+		port, err := os.OpenFile(serial, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		dc.ports = append(dc.ports, port)
+
+		if baudRate == 0 {
+			baudRate = 9600
+		}
+		cl := NewRTUClient(port, baudRate)
+		if dc.rtu == nil {
+			dc.rtu = make(map[string]Client)
+		}
+		dc.rtu[serial] = cl
+		return cl, nil
+	default:
+		return nil, errors.New("one of Address and Serial must be set")
+	}
+}
+
+// close serial lines of RTU clients
+func (dc *deviceClients) close() {
+	for _, port := range dc.ports {
+		port.Close()
+	}
+	dc.ports = nil
+}
@@ -0,0 +1,225 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestClient creates client of local server, it is closed at the end of test
+func newTestClient(t *testing.T, port int) Client {
+	cl := NewTCPClient("127.0.0.1", port)
+	cl.SetTimeout(2 * time.Second)
+	t.Cleanup(func() {
+		cl.Close()
+	})
+	return cl
+}
+
+// startStubDevice serves connections one by one by handle (connection is closed after handle returns)
+func startStubDevice(t *testing.T, handle func(conn net.Conn, framer Framer)) (port int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			handle(conn, NewMBAPFramer(conn))
+			conn.Close()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// stubResponse creates ADU of response to request with PDU (function code + data)
+func stubResponse(request []byte, pdu ...byte) []byte {
+	return mbap(uint16(request[0])<<8|uint16(request[1]), request[6], pdu...)
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	chanCommand := make(chan [2]string, 8)
+	sm.SetCommandChannel(chanCommand)
+	sm.WriteValues("Node1/relay", "1")
+	sm.WriteValues("Node1/alarm", "0")
+	sm.WriteValues("Node1/di", "1")
+	sm.WriteValues("Node1/volt1", "1.5")
+	sm.WriteValues("Node1/volt2", "2")
+	sm.WriteValues("Node1/count", "513")
+	sm.WriteValues("Node1/inp", "-1")
+	_, port := startTestServer(t, sm)
+	cl := newTestClient(t, port)
+
+	t.Run("read coils", func(t *testing.T) {
+		values, err := cl.ReadCoils(1, 0, 2)
+		if err != nil || !reflect.DeepEqual(values, []bool{true, false}) {
+			t.Errorf("values %v, error %v", values, err)
+		}
+	})
+	t.Run("read discrete inputs", func(t *testing.T) {
+		values, err := cl.ReadDiscreteInputs(1, 5, 1)
+		if err != nil || !reflect.DeepEqual(values, []bool{true}) {
+			t.Errorf("values %v, error %v", values, err)
+		}
+	})
+	t.Run("read holding registers", func(t *testing.T) {
+		regs, err := cl.ReadHoldingRegisters(1, 100, 5)
+		if err != nil || !reflect.DeepEqual(regs, []uint16{0x3FC0, 0, 0x4000, 0, 513}) {
+			t.Errorf("registers %04X, error %v", regs, err)
+		}
+	})
+	t.Run("read input registers", func(t *testing.T) {
+		regs, err := cl.ReadInputRegisters(1, 200, 2)
+		if err != nil || !reflect.DeepEqual(regs, []uint16{0xBF80, 0}) {
+			t.Errorf("registers %04X, error %v", regs, err)
+		}
+	})
+
+	writes := []struct {
+		name     string
+		write    func() error
+		commands [][2]string
+	}{
+		{"write single coil", func() error { return cl.WriteSingleCoil(1, 1, true) },
+			[][2]string{{"/modbus/Node1/alarm/set", "true"}}},
+		{"write single register", func() error { return cl.WriteSingleRegister(1, 104, 1000) },
+			[][2]string{{"/modbus/Node1/count/set", "1000"}}},
+		{"write multiple coils", func() error { return cl.WriteMultipleCoils(1, 0, []bool{false, true}) },
+			[][2]string{{"/modbus/Node1/relay/set", "false"}, {"/modbus/Node1/alarm/set", "true"}}},
+		{"write multiple registers", func() error { return cl.WriteMultipleRegisters(1, 100, []uint16{0x4040, 0, 0x40A0, 0}) },
+			[][2]string{{"/modbus/Node1/volt1/set", "3"}, {"/modbus/Node1/volt2/set", "5"}}},
+	}
+	for _, test := range writes {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.write(); err != nil {
+				t.Fatal(err)
+			}
+			var commands [][2]string
+			for len(chanCommand) > 0 {
+				commands = append(commands, <-chanCommand)
+			}
+			if !reflect.DeepEqual(commands, test.commands) {
+				t.Errorf("commands %v, want %v", commands, test.commands)
+			}
+		})
+	}
+}
+
+func TestClientException(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/relay", "1")
+	_, port := startTestServer(t, sm)
+	cl := newTestClient(t, port)
+
+	_, err := cl.ReadHoldingRegisters(1, 300, 2)
+	var errHandler ErrorHandler
+	if !errors.As(err, &errHandler) {
+		t.Fatalf("got error %v, want ErrorHandler", err)
+	}
+	if errHandler.FunctionCode != FuncCodeReadHoldingRegisters || errHandler.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Errorf("exception %+v", errHandler)
+	}
+
+	// Connection stays open after exception
+	if _, err := cl.ReadCoils(1, 0, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	// Device answers one request and drops connection
+	port := startStubDevice(t, func(conn net.Conn, framer Framer) {
+		request, err := framer.ReadADU()
+		if err != nil {
+			return
+		}
+		framer.WriteADU(stubResponse(request, FuncCodeReadHoldingRegisters, 2, 0x12, 0x34))
+	})
+	cl := newTestClient(t, port)
+
+	if regs, err := cl.ReadHoldingRegisters(1, 0, 1); err != nil || regs[0] != 0x1234 {
+		t.Fatalf("registers %04X, error %v", regs, err)
+	}
+	// Request sent to dropped connection fails, next one opens new connection
+	if _, err := cl.ReadHoldingRegisters(1, 0, 1); err == nil {
+		t.Error("request to dropped connection succeeded")
+	}
+	if regs, err := cl.ReadHoldingRegisters(1, 0, 1); err != nil || regs[0] != 0x1234 {
+		t.Errorf("registers %04X, error %v", regs, err)
+	}
+}
+
+func TestClientStaleTransactionID(t *testing.T) {
+	// Device sends response of older request before response of current request
+	port := startStubDevice(t, func(conn net.Conn, framer Framer) {
+		request, err := framer.ReadADU()
+		if err != nil {
+			return
+		}
+		stale := stubResponse(request, FuncCodeReadHoldingRegisters, 2, 0xDE, 0xAD)
+		stale[1]--
+		framer.WriteADU(stale)
+		framer.WriteADU(stubResponse(request, FuncCodeReadHoldingRegisters, 2, 0x12, 0x34))
+		framer.ReadADU()
+	})
+	cl := newTestClient(t, port)
+
+	if regs, err := cl.ReadHoldingRegisters(1, 0, 1); err != nil || regs[0] != 0x1234 {
+		t.Errorf("registers %04X, error %v", regs, err)
+	}
+}
+
+func TestClientReadWriteMultipleRegisters(t *testing.T) {
+	// Server of smart meter does not support FC 23, so stub device checks request and answers it
+	chanRequest := make(chan []byte, 1)
+	port := startStubDevice(t, func(conn net.Conn, framer Framer) {
+		request, err := framer.ReadADU()
+		if err != nil {
+			return
+		}
+		chanRequest <- request
+		framer.WriteADU(stubResponse(request, FuncCodeReadWriteMultipleRegisters, 4, 0x00, 0x01, 0x00, 0x02))
+		framer.ReadADU()
+	})
+	cl := newTestClient(t, port)
+
+	regs, err := cl.ReadWriteMultipleRegisters(3, 100, 2, 200, []uint16{0xABCD})
+	if err != nil || !reflect.DeepEqual(regs, []uint16{1, 2}) {
+		t.Errorf("registers %04X, error %v", regs, err)
+	}
+	request := <-chanRequest
+	if want := []byte{3, FuncCodeReadWriteMultipleRegisters, 0, 100, 0, 2, 0, 200, 0, 1, 2, 0xAB, 0xCD}; !bytes.Equal(request[6:], want) {
+		t.Errorf("request % X, want % X", request[6:], want)
+	}
+}
+
+func TestClientInvalidResponse(t *testing.T) {
+	// Device answers by other function code
+	port := startStubDevice(t, func(conn net.Conn, framer Framer) {
+		request, err := framer.ReadADU()
+		if err != nil {
+			return
+		}
+		framer.WriteADU(stubResponse(request, FuncCodeReadInputRegisters, 2, 0, 1))
+		framer.ReadADU()
+	})
+	cl := newTestClient(t, port)
+
+	if _, err := cl.ReadHoldingRegisters(1, 0, 1); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidResponse)
+	}
+}
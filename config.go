@@ -0,0 +1,613 @@
+package modbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// RegisterAccesses of registers (coils), see @RegisterJSON.Access
+const (
+	RegisterAccessReadWrite = 0
+	// Writing is refused by IllegalDataAddress exception
+	RegisterAccessRead = 1
+	// Reading is refused by IllegalDataAddress exception
+	RegisterAccessWrite = 2
+)
+
+// registerAccessNames maps names of accesses in config to @RegisterAccess consts
+var registerAccessNames = map[string]int{
+	"readwrite": RegisterAccessReadWrite,
+	"read":      RegisterAccessRead,
+	"write":     RegisterAccessWrite,
+}
+
+// ConfigJSON is structured config of smart meter, see example conf.json.comment file,
+// legacy layout with parallel arrays (see @MappingJSONTable) is converted to it by @LoadConfig
+type ConfigJSON struct {
+	Devices []DeviceJSON
+	Types   []TypeJSON
+	// Topic for publishing written values, {nodeID} and {topic} are replaced (optional, see @DefaultCommandTopic)
+	CommandTopic string `json:",omitempty"`
+	// How to read unmapped registers inside requested block, see @GapPolicy consts
+	GapPolicy int `json:",omitempty"`
+	// Exception code for stale values (optional, GatewayTargetDeviceFailedToRespond if it is 0)
+	StaleExceptionCode int `json:",omitempty"`
+	// Sentinel value returned instead of stale values, exception is returned if it is null (optional)
+	StaleValue *string `json:",omitempty"`
+}
+
+// DeviceJSON maps unit ID (modbus) to node ID (mqtt) and type of smart meter
+type DeviceJSON struct {
+	UnitID int
+	NodeID string
+	// Index to Types
+	Type int
+	// Max age of values in seconds, 0 if values do not expire (optional)
+	MaxAge int `json:",omitempty"`
+}
+
+// TypeJSON is type of smart meter with its registers
+type TypeJSON struct {
+	// Description of type (optional)
+	Name      string `json:",omitempty"`
+	Registers []RegisterJSON
+}
+
+// RegisterJSON maps register (coil) to MQTT topic
+type RegisterJSON struct {
+	Address int
+	Topic   string
+	// Value type, see @ValueType consts
+	ValueType int
+	// Data block, see @DataBlock consts (optional, holding registers if it is missing)
+	DataBlock int `json:",omitempty"`
+	// Byte order, "ABCD", "DCBA", "BADC" or "CDAB" (optional, "ABCD" if it is missing)
+	ByteOrder string `json:",omitempty"`
+	// Access of modbus clients, "read", "write" or "readwrite" (optional, "readwrite" if it is missing, input registers and discrete inputs are read only)
+	Access string `json:",omitempty"`
+	// Scale factor and offset, value * scale + offset is encoded (optional, 1 and 0 if they are missing)
+	Scale  *float64 `json:",omitempty"`
+	Offset float64  `json:",omitempty"`
+	// Clamp range of scaled value (optional, not limited if it is missing)
+	Min *float64 `json:",omitempty"`
+	Max *float64 `json:",omitempty"`
+	// Max age of value in seconds, 0 if max age of device is used (optional)
+	MaxAge int `json:",omitempty"`
+}
+
+// Kinds of invalid items of config, see @ConfigError.Err (use errors.Is)
+var (
+	// Device refers to unknown type
+	ErrConfigUnitReference = errors.New("modbus: invalid unit reference")
+	// Unit ID or node ID is used by more devices
+	ErrConfigDuplicateUnit = errors.New("modbus: duplicate unit")
+	// Register is used by more values of type
+	ErrConfigDuplicateRegister = errors.New("modbus: duplicate register")
+	ErrConfigUnknownValueType  = errors.New("modbus: unknown value type")
+	// Unit ID 0 is mapped, but it is broadcast in RTU and ASCII, see @ConfigJSON.ValidateSerial
+	ErrConfigBroadcastUnit = errors.New("modbus: broadcast unit")
+	// Other invalid items
+	ErrConfigInvalid = errors.New("modbus: invalid config item")
+)
+
+// ConfigSyntaxError is config which can not be decoded, Line and Column (from 1) are position of error
+type ConfigSyntaxError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ConfigSyntaxError) Error() string {
+	return fmt.Sprintf("modbus: config syntax error at line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *ConfigSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// configSyntaxError finds position of decoding error in config, errors without position are returned unchanged
+func configSyntaxError(data []byte, err error) error {
+
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+
+	// Offset is number of bytes read before error, ie. error is at its last byte
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	line, column := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	return &ConfigSyntaxError{Line: line, Column: column, Err: err}
+}
+
+// ConfigError is invalid item of config, Path is JSON path of the item, i.e. "$.Types[0].Registers[2].ValueType"
+type ConfigError struct {
+	Path    string
+	Message string
+	// Kind of error, see @ErrConfig vars
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all errors found in config
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return "modbus: invalid config: " + strings.Join(messages, "; ")
+}
+
+// Unwrap returns all errors, so errors.Is and errors.As find any of them
+func (errs ConfigErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, e := range errs {
+		unwrapped[i] = e
+	}
+	return unwrapped
+}
+
+func (errs *ConfigErrors) add(path string, err error, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{Path: path, Message: fmt.Sprintf(format, args...), Err: err})
+}
+
+// result returns errors as error, nil if there are no errors
+func (errs ConfigErrors) result() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// legacyKeys are top level keys of config replaced by structured layout
+var legacyKeys = []string{"UnitID", "NodeID", "Type", "Types", "MaxAges", "Devices", "CommandTopic", "GapPolicy", "StaleExceptionCode", "StaleValue"}
+
+/**
+* LoadConfig reads and validates config file of smart meter, see @ReadConfig
+* @param config string path to config file, see @conf.json as example file
+* @return error *os.PathError if file can not be opened (errors.Is(err, os.ErrNotExist) if it does not exist), see @ReadConfig for other errors
+ */
+func LoadConfig(config string) (*ConfigJSON, error) {
+
+	file, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadConfig(file)
+}
+
+/**
+* ReadConfig reads and validates config of smart meter, legacy layout is converted (config without "Devices" is legacy)
+* @param r io.Reader with config (JSON)
+* @return error *ConfigSyntaxError if config can not be decoded, ConfigErrors with all invalid items of config
+ */
+func ReadConfig(r io.Reader) (*ConfigJSON, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cfg.validate().result(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+/**
+* ConvertConfig converts config file with legacy layout to structured layout, other sections of config are kept
+* @param config string path to config file with legacy layout
+* @return data []byte indented JSON of converted config
+ */
+func ConvertConfig(config string) (data []byte, err error) {
+
+	data, err = os.ReadFile(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		return nil, configSyntaxError(data, err)
+	}
+	if isStructured(sections) {
+		return nil, errors.New("modbus: config has structured layout already")
+	}
+
+	var legacy MappingJSONTable
+	if err = json.Unmarshal(data, &legacy); err != nil {
+		return nil, configSyntaxError(data, err)
+	}
+	cfg, errs := convertLegacyConfig(legacy)
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	if err = errs.result(); err != nil {
+		return nil, err
+	}
+
+	// Structured sections replace legacy ones (keys are case insensitive)
+	for key := range sections {
+		for _, legacyKey := range legacyKeys {
+			if strings.EqualFold(key, legacyKey) {
+				delete(sections, key)
+			}
+		}
+	}
+	converted, _ := json.Marshal(cfg)
+	var convertedSections map[string]json.RawMessage
+	json.Unmarshal(converted, &convertedSections)
+	for key, section := range convertedSections {
+		sections[key] = section
+	}
+
+	return json.MarshalIndent(sections, "", "    ")
+}
+
+// isStructured checks if config has structured layout, ie. it includes "Devices"
+func isStructured(sections map[string]json.RawMessage) bool {
+	for key := range sections {
+		if strings.EqualFold(key, "Devices") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfig decodes structured or legacy config, unknown fields of devices, types and registers are reported (they are typically typos)
+func parseConfig(data []byte) (cfg ConfigJSON, err error) {
+
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		return cfg, configSyntaxError(data, err)
+	}
+
+	if !isStructured(sections) {
+		var legacy MappingJSONTable
+		if err = json.Unmarshal(data, &legacy); err != nil {
+			return cfg, configSyntaxError(data, err)
+		}
+		cfg, errs := convertLegacyConfig(legacy)
+		return cfg, errs.result()
+	}
+
+	// Devices and types are decoded item by item, so errors have exact path
+	top := struct {
+		*ConfigJSON
+		Devices []json.RawMessage
+		Types   []json.RawMessage
+	}{ConfigJSON: &cfg}
+	if err = json.Unmarshal(data, &top); err != nil {
+		return cfg, configSyntaxError(data, err)
+	}
+
+	var errs ConfigErrors
+
+	cfg.Devices = make([]DeviceJSON, len(top.Devices))
+	for i, device := range top.Devices {
+		errs.decodeStrict(fmt.Sprintf("$.Devices[%d]", i), device, &cfg.Devices[i])
+	}
+
+	cfg.Types = make([]TypeJSON, len(top.Types))
+	for i, smType := range top.Types {
+		path := fmt.Sprintf("$.Types[%d]", i)
+		var rawType struct {
+			Name      string
+			Registers []json.RawMessage
+		}
+		if !errs.decodeStrict(path, smType, &rawType) {
+			continue
+		}
+		cfg.Types[i].Name = rawType.Name
+		cfg.Types[i].Registers = make([]RegisterJSON, len(rawType.Registers))
+		for j, register := range rawType.Registers {
+			errs.decodeStrict(fmt.Sprintf("%s.Registers[%d]", path, j), register, &cfg.Types[i].Registers[j])
+		}
+	}
+
+	return cfg, errs.result()
+}
+
+// decodeStrict decodes item of config, unknown fields are not allowed
+func (errs *ConfigErrors) decodeStrict(path string, data json.RawMessage, v interface{}) bool {
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return true
+	}
+
+	if typeErr, flag := err.(*json.UnmarshalTypeError); flag && typeErr.Field != "" {
+		errs.add(path+"."+typeErr.Field, ErrConfigInvalid, "expected %v, got %s", typeErr.Type, typeErr.Value)
+	} else {
+		errs.add(path, ErrConfigInvalid, "%s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return false
+}
+
+// convertLegacyConfig converts legacy layout with parallel arrays (see @MappingJSONTable) to structured config, lengths of arrays are checked
+func convertLegacyConfig(legacy MappingJSONTable) (cfg ConfigJSON, errs ConfigErrors) {
+
+	cfg = ConfigJSON{CommandTopic: legacy.CommandTopic, GapPolicy: legacy.GapPolicy, StaleExceptionCode: legacy.StaleExceptionCode,
+		StaleValue: legacy.StaleValue}
+
+	// Node IDs and types are required for each unit, max ages are optional
+	unitsNum := len(legacy.UnitID)
+	valid := errs.checkLength("$.NodeID", len(legacy.NodeID), unitsNum, "UnitID", false)
+	valid = errs.checkLength("$.Type", len(legacy.Type), unitsNum, "UnitID", false) && valid
+	valid = errs.checkLength("$.MaxAges", len(legacy.MaxAges), unitsNum, "UnitID", true) && valid
+	if valid {
+		for index := 0; index < unitsNum; index++ {
+			device := DeviceJSON{UnitID: legacy.UnitID[index], NodeID: legacy.NodeID[index], Type: legacy.Type[index]}
+			if len(legacy.MaxAges) != 0 {
+				device.MaxAge = legacy.MaxAges[index]
+			}
+			cfg.Devices = append(cfg.Devices, device)
+		}
+	}
+
+	cfg.Types = make([]TypeJSON, len(legacy.Types))
+	for index, smType := range legacy.Types {
+		path := fmt.Sprintf("$.Types[%d]", index)
+
+		// Topics and value types are required for each register, other arrays are optional
+		registersNum := len(smType.Numbers)
+		valid := errs.checkLength(path+".Topics", len(smType.Topics), registersNum, "Numbers", false)
+		valid = errs.checkLength(path+".ValueTypes", len(smType.ValueTypes), registersNum, "Numbers", false) && valid
+		valid = errs.checkLength(path+".DataBlocks", len(smType.DataBlocks), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".ByteOrders", len(smType.ByteOrders), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".Scales", len(smType.Scales), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".Offsets", len(smType.Offsets), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".Mins", len(smType.Mins), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".Maxs", len(smType.Maxs), registersNum, "Numbers", true) && valid
+		valid = errs.checkLength(path+".MaxAges", len(smType.MaxAges), registersNum, "Numbers", true) && valid
+		if !valid {
+			continue
+		}
+
+		for t := 0; t < registersNum; t++ {
+			register := RegisterJSON{Address: smType.Numbers[t], Topic: smType.Topics[t], ValueType: smType.ValueTypes[t]}
+			if len(smType.DataBlocks) != 0 {
+				register.DataBlock = smType.DataBlocks[t]
+			}
+			if len(smType.ByteOrders) != 0 {
+				register.ByteOrder = smType.ByteOrders[t]
+			}
+			if len(smType.Scales) != 0 {
+				scale := smType.Scales[t]
+				register.Scale = &scale
+			}
+			if len(smType.Offsets) != 0 {
+				register.Offset = smType.Offsets[t]
+			}
+			if len(smType.Mins) != 0 {
+				register.Min = smType.Mins[t]
+			}
+			if len(smType.Maxs) != 0 {
+				register.Max = smType.Maxs[t]
+			}
+			if len(smType.MaxAges) != 0 {
+				register.MaxAge = smType.MaxAges[t]
+			}
+			cfg.Types[index].Registers = append(cfg.Types[index].Registers, register)
+		}
+	}
+
+	return cfg, errs
+}
+
+// checkLength checks length of parallel array of legacy config, optional array can be empty
+func (errs *ConfigErrors) checkLength(path string, length int, expected int, name string, optional bool) bool {
+	if length == expected || (optional && length == 0) {
+		return true
+	}
+	errs.add(path, ErrConfigInvalid, "length %d differs from length %d of %s", length, expected, name)
+	return false
+}
+
+/**
+* ValidateSerial checks that config can be served by RTU or ASCII framing (serial line, RTU over TCP, ASCII),
+* unit ID 0 is broadcast there and requests to it are never answered
+* @return error ConfigErrors with devices mapped to unit ID 0 (ErrConfigBroadcastUnit), nil if config is valid
+ */
+func (cfg *ConfigJSON) ValidateSerial() error {
+
+	var errs ConfigErrors
+	for i, device := range cfg.Devices {
+		if device.UnitID == 0 {
+			errs.add(fmt.Sprintf("$.Devices[%d].UnitID", i), ErrConfigBroadcastUnit, "unit ID 0 is broadcast in RTU and ASCII, use 1-247")
+		}
+	}
+
+	return errs.result()
+}
+
+// validate checks all items of config, every invalid item is reported
+func (cfg *ConfigJSON) validate() (errs ConfigErrors) {
+
+	unitIDs := make(map[int]int)
+	nodeIDs := make(map[string]int)
+	for i, device := range cfg.Devices {
+		path := fmt.Sprintf("$.Devices[%d]", i)
+
+		if device.UnitID < 0 || device.UnitID > 0xFF {
+			errs.add(path+".UnitID", ErrConfigInvalid, "unit ID %d out of range 0-255", device.UnitID)
+		} else if first, flag := unitIDs[device.UnitID]; flag {
+			errs.add(path+".UnitID", ErrConfigDuplicateUnit, "unit ID %d is used by $.Devices[%d] already", device.UnitID, first)
+		} else {
+			unitIDs[device.UnitID] = i
+		}
+
+		if device.NodeID == "" {
+			errs.add(path+".NodeID", ErrConfigInvalid, "node ID is empty")
+		} else if first, flag := nodeIDs[device.NodeID]; flag {
+			errs.add(path+".NodeID", ErrConfigDuplicateUnit, "node ID %q is used by $.Devices[%d] already", device.NodeID, first)
+		} else {
+			nodeIDs[device.NodeID] = i
+		}
+
+		if device.Type < 0 || device.Type >= len(cfg.Types) {
+			errs.add(path+".Type", ErrConfigUnitReference, "unknown type %d", device.Type)
+		}
+		if device.MaxAge < 0 {
+			errs.add(path+".MaxAge", ErrConfigInvalid, "max age %d is negative", device.MaxAge)
+		}
+	}
+
+	for i, smType := range cfg.Types {
+		// map[dataBlock][address] = index of register occupying address
+		occupied := make(map[int]map[int]int)
+		for j, register := range smType.Registers {
+			path := fmt.Sprintf("$.Types[%d].Registers[%d]", i, j)
+			if !errs.validateRegister(path, register) {
+				continue
+			}
+
+			// Values can not overlap, each register belongs to one value
+			if occupied[register.DataBlock] == nil {
+				occupied[register.DataBlock] = make(map[int]int)
+			}
+			for k := 0; k < int(valueTypeLength(register.ValueType)); k++ {
+				if first, flag := occupied[register.DataBlock][register.Address+k]; flag {
+					errs.add(path+".Address", ErrConfigDuplicateRegister, "register %d overlaps $.Types[%d].Registers[%d]", register.Address+k, i, first)
+					break
+				}
+				occupied[register.DataBlock][register.Address+k] = j
+			}
+		}
+	}
+
+	if cfg.GapPolicy != GapPolicyIllegalAddress && cfg.GapPolicy != GapPolicyZeroFill {
+		errs.add("$.GapPolicy", ErrConfigInvalid, "unknown gap policy %d", cfg.GapPolicy)
+	}
+	if cfg.StaleExceptionCode < 0 || cfg.StaleExceptionCode > 0xFF {
+		errs.add("$.StaleExceptionCode", ErrConfigInvalid, "exception code %d out of range 0-255", cfg.StaleExceptionCode)
+	}
+
+	return errs
+}
+
+// validateRegister checks one register of type, false is returned if it is invalid
+func (errs *ConfigErrors) validateRegister(path string, register RegisterJSON) bool {
+
+	errsNum := len(*errs)
+
+	if register.Topic == "" {
+		errs.add(path+".Topic", ErrConfigInvalid, "topic is empty")
+	}
+
+	// Bits (coils and discrete inputs) are bool values only, registers can not be bool
+	length := int(valueTypeLength(register.ValueType))
+	if length == 0 {
+		errs.add(path+".ValueType", ErrConfigUnknownValueType, "unknown value type %d", register.ValueType)
+	}
+	switch register.DataBlock {
+	case DataBlockHoldingRegisters, DataBlockInputRegisters:
+		if register.ValueType == ValueTypeBOOL {
+			errs.add(path+".ValueType", ErrConfigInvalid, "register can not be bool")
+		}
+	case DataBlockCoils, DataBlockDiscreteInputs:
+		if length != 0 && register.ValueType != ValueTypeBOOL {
+			errs.add(path+".ValueType", ErrConfigInvalid, "coil/discrete input must be bool")
+		}
+	default:
+		errs.add(path+".DataBlock", ErrConfigInvalid, "unknown data block %d", register.DataBlock)
+	}
+
+	if register.Address < 0 || register.Address > 0xFFFF {
+		errs.add(path+".Address", ErrConfigInvalid, "address %d out of range 0-65535", register.Address)
+	} else if register.Address+length > 0x10000 {
+		errs.add(path+".Address", ErrConfigInvalid, "value at address %d exceeds address 65535", register.Address)
+	}
+
+	if _, flag := byteOrderNames[register.ByteOrder]; register.ByteOrder != "" && !flag {
+		errs.add(path+".ByteOrder", ErrConfigInvalid, "unknown byte order %q", register.ByteOrder)
+	}
+
+	access, flag := registerAccessNames[register.Access]
+	if register.Access != "" && !flag {
+		errs.add(path+".Access", ErrConfigInvalid, "unknown access %q", register.Access)
+	} else if access != RegisterAccessRead && register.Access != "" &&
+		(register.DataBlock == DataBlockInputRegisters || register.DataBlock == DataBlockDiscreteInputs) {
+		errs.add(path+".Access", ErrConfigInvalid, "input register/discrete input is read only")
+	}
+
+	// Scale is used for division when value is written
+	if register.Scale != nil && *register.Scale == 0 {
+		errs.add(path+".Scale", ErrConfigInvalid, "scale is zero")
+	}
+	if register.Min != nil && register.Max != nil && *register.Min > *register.Max {
+		errs.add(path+".Min", ErrConfigInvalid, "min %v is greater than max %v", *register.Min, *register.Max)
+	}
+	if register.MaxAge < 0 {
+		errs.add(path+".MaxAge", ErrConfigInvalid, "max age %d is negative", register.MaxAge)
+	}
+
+	return len(*errs) == errsNum
+}
+
+// buildTypes converts types of validated config to mapping tables (shared by smart meter and poller), see @MappingAllTypeTable
+func buildTypes(types []TypeJSON) []MappingAllTypeTable {
+
+	smTypes := make([]MappingAllTypeTable, len(types))
+	for index, smType := range types {
+		smTypes[index].mType = make(map[int]map[int]MappingTypeTable)
+
+		for _, register := range smType.Registers {
+			mapping := MappingTypeTable{topic: register.Topic, valType: register.ValueType, byteOrder: byteOrderNames[register.ByteOrder],
+				access: registerAccessNames[register.Access], scale: 1, offset: register.Offset, min: register.Min, max: register.Max,
+				maxAge: time.Duration(register.MaxAge) * time.Second}
+			if register.Scale != nil {
+				mapping.scale = *register.Scale
+			}
+
+			if smTypes[index].mType[register.DataBlock] == nil {
+				smTypes[index].mType[register.DataBlock] = make(map[int]MappingTypeTable)
+			}
+			smTypes[index].mType[register.DataBlock][register.Address] = mapping
+		}
+	}
+
+	return smTypes
+}
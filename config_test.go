@@ -0,0 +1,169 @@
+package modbus
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidateSerial(t *testing.T) {
+	cfg := testConfig()
+	if err := cfg.ValidateSerial(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	cfg.Devices = append(cfg.Devices, DeviceJSON{UnitID: 0, NodeID: "Node0", Type: 0})
+	err := cfg.ValidateSerial()
+	if !errors.Is(err, ErrConfigBroadcastUnit) {
+		t.Fatalf("got error %v, want %v", err, ErrConfigBroadcastUnit)
+	}
+	if errs := err.(ConfigErrors); len(errs) != 1 || errs[0].Path != "$.Devices[1].UnitID" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestConfigExample(t *testing.T) {
+	// Example config maps unit ID 0, so it is valid for modbus TCP only
+	cfg, err := LoadConfig("main/conf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidateSerial(); !errors.Is(err, ErrConfigBroadcastUnit) {
+		t.Errorf("got error %v, want %v", err, ErrConfigBroadcastUnit)
+	}
+
+	cfg, err = LoadConfig("testdata/conf_serial.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidateSerial(); err != nil {
+		t.Errorf("serial config can not be used by RTU server: %v", err)
+	}
+}
+
+func TestConfigNotExist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.json")
+
+	if _, err := NewSmartMeter(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewSmartMeter: got error %v, want %v", err, os.ErrNotExist)
+	}
+	if _, err := LoadConfig(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadConfig: got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestConfigSyntaxError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		line   int
+		column int
+	}{
+		{"extra comma", "{\n  \"Devices\": [\n    {\"UnitID\": 1,,}\n  ]\n}", 3, 18},
+		{"devices are not array", "{\n  \"Devices\": {}\n}", 2, 14},
+		{"legacy unit IDs are not array", "{\"UnitID\": \"1\"}", 1, 14},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewSmartMeterFromReader(strings.NewReader(test.config))
+			var syntaxErr *ConfigSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("got error %v, want *ConfigSyntaxError", err)
+			}
+			if syntaxErr.Line != test.line || syntaxErr.Column != test.column {
+				t.Errorf("position %d:%d, want %d:%d (%v)", syntaxErr.Line, syntaxErr.Column, test.line, test.column, err)
+			}
+		})
+	}
+}
+
+func TestConfigErrorPaths(t *testing.T) {
+	type configError struct {
+		path string
+		err  error
+	}
+	tests := []struct {
+		name   string
+		config string
+		errors []configError
+	}{
+		{"unknown type", `{"Devices": [{"UnitID": 1, "NodeID": "Node1", "Type": 1}], "Types": [{"Registers": []}]}`,
+			[]configError{{"$.Devices[0].Type", ErrConfigUnitReference}}},
+		{"duplicate unit", `{"Devices": [{"UnitID": 1, "NodeID": "Node1"}, {"UnitID": 1, "NodeID": "Node2"}], "Types": [{}]}`,
+			[]configError{{"$.Devices[1].UnitID", ErrConfigDuplicateUnit}}},
+		{"duplicate node", `{"Devices": [{"UnitID": 1, "NodeID": "Node1"}, {"UnitID": 2, "NodeID": "Node1"}], "Types": [{}]}`,
+			[]configError{{"$.Devices[1].NodeID", ErrConfigDuplicateUnit}}},
+		{"overlapping registers", `{"Devices": [], "Types": [{"Registers": [
+				{"Address": 0, "Topic": "a", "ValueType": 1},
+				{"Address": 1, "Topic": "b", "ValueType": 6}]}]}`,
+			[]configError{{"$.Types[0].Registers[1].Address", ErrConfigDuplicateRegister}}},
+		{"unknown value type", `{"Devices": [], "Types": [{}, {"Registers": [{"Address": 0, "Topic": "a", "ValueType": 42}]}]}`,
+			[]configError{{"$.Types[1].Registers[0].ValueType", ErrConfigUnknownValueType}}},
+		{"unknown field", `{"Devices": [{"UnitID": 1, "NodeID": "Node1", "Adress": 3}], "Types": [{}]}`,
+			[]configError{{"$.Devices[0]", ErrConfigInvalid}}},
+		{"invalid field type", `{"Devices": [], "Types": [{"Registers": [{"Address": 0, "Topic": "a", "ValueType": "float"}]}]}`,
+			[]configError{{"$.Types[0].Registers[0].ValueType", ErrConfigInvalid}}},
+		{"invalid items", `{"Devices": [{"UnitID": 300, "NodeID": "", "MaxAge": -1}], "Types": [{"Registers": [
+				{"Address": 0, "Topic": "", "ValueType": 4},
+				{"Address": 2, "Topic": "b", "ValueType": 6, "DataBlock": 1, "Access": "write"},
+				{"Address": 4, "Topic": "c", "ValueType": 6, "Scale": 0, "ByteOrder": "XYZW"}]}],
+			"GapPolicy": 3}`,
+			[]configError{
+				{"$.Devices[0].UnitID", ErrConfigInvalid},
+				{"$.Devices[0].NodeID", ErrConfigInvalid},
+				{"$.Devices[0].MaxAge", ErrConfigInvalid},
+				{"$.Types[0].Registers[0].Topic", ErrConfigInvalid},
+				{"$.Types[0].Registers[0].ValueType", ErrConfigInvalid},
+				{"$.Types[0].Registers[1].Access", ErrConfigInvalid},
+				{"$.Types[0].Registers[2].ByteOrder", ErrConfigInvalid},
+				{"$.Types[0].Registers[2].Scale", ErrConfigInvalid},
+				{"$.GapPolicy", ErrConfigInvalid},
+			}},
+		{"legacy lengths", `{"UnitID": [1, 2], "NodeID": ["Node1"], "Type": [0, 0],
+			"Types": [{"numbers": [1, 2], "topics": ["a"], "valueTypes": [6, 6], "scales": [1]}]}`,
+			[]configError{
+				{"$.NodeID", ErrConfigInvalid},
+				{"$.Types[0].Topics", ErrConfigInvalid},
+				{"$.Types[0].Scales", ErrConfigInvalid},
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewSmartMeterFromReader(strings.NewReader(test.config))
+			var errs ConfigErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("got error %v, want ConfigErrors", err)
+			}
+			for _, want := range test.errors {
+				if !errors.Is(err, want.err) {
+					t.Errorf("errors.Is(err, %v) is false", want.err)
+				}
+			}
+
+			paths := make([]string, len(errs))
+			for i, e := range errs {
+				paths[i] = e.Path
+			}
+			if len(errs) != len(test.errors) {
+				t.Fatalf("errors at %v, want %d errors", paths, len(test.errors))
+			}
+			for i, want := range test.errors {
+				if errs[i].Path != want.path || !errors.Is(errs[i], want.err) {
+					t.Errorf("error %d: %v (%v), want path %s (%v)", i, errs[i], errs[i].Err, want.path, want.err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigFromStruct(t *testing.T) {
+	cfg := testConfig()
+	cfg.Devices[0].Type = 2
+	if _, err := NewSmartMeterFromConfig(cfg); !errors.Is(err, ErrConfigUnitReference) {
+		t.Errorf("got error %v, want %v", err, ErrConfigUnitReference)
+	}
+}
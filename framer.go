@@ -0,0 +1,77 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrFrameLength is returned by framer if length of received frame is out of modbus range
+var ErrFrameLength = errors.New("modbus: invalid frame length")
+
+// ErrUnknownFunction is returned by framer together with ADU without data (unit ID + function code) if length of request can not be determined from its function code
+var ErrUnknownFunction = errors.New("modbus: unknown function code")
+
+// FramingModes of TCP server, see @Server.SetFraming
+const (
+	// Modbus TCP (MBAP header + PDU)
+	FramingMBAP = 0
+	// RTU frames (unit ID + PDU + CRC) tunneled over TCP
+	FramingRTUOverTCP = 1
+	// Modbus ASCII (":" + hex + LRC + CRLF)
+	FramingASCII = 2
+)
+
+// Framer splits stream to ADUs (MBAP + PDU), it is created for each connection
+type Framer interface {
+	// Read next complete ADU from stream
+	ReadADU() (adu []byte, err error)
+
+	// Write ADU to stream
+	WriteADU(adu []byte) (err error)
+}
+
+// mbapFramer reads ADUs according to length in MBAP header, implements Framer interface
+type mbapFramer struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// NewMBAPFramer creates framer for modbus TCP stream
+func NewMBAPFramer(rw io.ReadWriter) Framer {
+	return &mbapFramer{r: bufio.NewReaderSize(rw, MaxADULength), w: rw}
+}
+
+/**
+* ReadADU reads MBAP header (7 bytes) and then exactly length - 1 bytes, more ADUs can be received in one read
+* @return adu []byte whole ADU (MBAP + PDU)
+ */
+func (f *mbapFramer) ReadADU() (adu []byte, err error) {
+
+	// transaction ID (2B) + protocol ID (2B) + length (2B) + unit ID (1B)
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(f.r, header); err != nil {
+		return nil, err
+	}
+
+	// Length includes unit ID and PDU (at least function code), whole ADU must fit to max ADU length
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || 6+length > MaxADULength {
+		return nil, ErrFrameLength
+	}
+
+	adu = make([]byte, 6+length)
+	copy(adu, header)
+	if _, err = io.ReadFull(f.r, adu[7:]); err != nil {
+		return nil, err
+	}
+
+	return adu, nil
+}
+
+// WriteADU writes ADU as it is
+func (f *mbapFramer) WriteADU(adu []byte) (err error) {
+	_, err = f.w.Write(adu)
+	return err
+}
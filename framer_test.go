@@ -0,0 +1,83 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// chunkStream returns each chunk in separate read (as separate TCP writes), then io.EOF
+type chunkStream struct {
+	chunks [][]byte
+	bytes.Buffer
+}
+
+func (s *chunkStream) Read(p []byte) (n int, err error) {
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestMBAPFramerReadADU(t *testing.T) {
+	adu1 := mbap(1, 1, FuncCodeReadHoldingRegisters, 0, 100, 0, 2)
+	adu2 := mbap(2, 3, FuncCodeReadCoils, 0, 0, 0, 8)
+	maxPDU := make([]byte, MaxADULength-7)
+	maxPDU[0] = FuncCodeWriteMultipleRegisters
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   [][]byte
+		err    error
+	}{
+		{"one write", [][]byte{adu1}, [][]byte{adu1}, io.EOF},
+		{"split header", [][]byte{adu1[:3], adu1[3:]}, [][]byte{adu1}, io.EOF},
+		{"split PDU", [][]byte{adu1[:8], adu1[8:10], adu1[10:]}, [][]byte{adu1}, io.EOF},
+		{"two ADUs in one write", [][]byte{append(append([]byte{}, adu1...), adu2...)}, [][]byte{adu1, adu2}, io.EOF},
+		{"ADU and part of next", [][]byte{append(append([]byte{}, adu1...), adu2[:5]...), adu2[5:]}, [][]byte{adu1, adu2}, io.EOF},
+		{"max length", [][]byte{mbap(1, 1, maxPDU...)}, [][]byte{mbap(1, 1, maxPDU...)}, io.EOF},
+		{"length 0", [][]byte{{0, 1, 0, 0, 0, 0, 1}}, nil, ErrFrameLength},
+		{"length 1", [][]byte{{0, 1, 0, 0, 0, 1, 1, 3}}, nil, ErrFrameLength},
+		{"length 255", [][]byte{mbap(1, 1, append(maxPDU, 0)...)}, nil, ErrFrameLength},
+		{"length 65535", [][]byte{{0, 1, 0, 0, 0xFF, 0xFF, 1, 3}}, nil, ErrFrameLength},
+		{"error after valid ADU", [][]byte{adu1, {0, 2, 0, 0, 0, 1, 1}}, [][]byte{adu1}, ErrFrameLength},
+		{"truncated PDU", [][]byte{adu1[:len(adu1)-1]}, nil, io.ErrUnexpectedEOF},
+		{"truncated header", [][]byte{adu1[:4]}, nil, io.ErrUnexpectedEOF},
+		{"empty stream", nil, nil, io.EOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			framer := NewMBAPFramer(&chunkStream{chunks: test.chunks})
+			for i, want := range test.want {
+				adu, err := framer.ReadADU()
+				if err != nil {
+					t.Fatalf("ADU %d: %v", i, err)
+				}
+				if !bytes.Equal(adu, want) {
+					t.Fatalf("ADU %d: got % X, want % X", i, adu, want)
+				}
+			}
+			if _, err := framer.ReadADU(); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMBAPFramerWriteADU(t *testing.T) {
+	stream := &chunkStream{}
+	adu := mbap(7, 1, FuncCodeReadHoldingRegisters, 2, 0, 100, 0)
+	if err := NewMBAPFramer(stream).WriteADU(adu); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stream.Bytes(), adu) {
+		t.Errorf("written % X, want % X", stream.Bytes(), adu)
+	}
+}
@@ -0,0 +1,173 @@
+package modbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Gateway forwards requests for unit IDs not mapped to smart meter to downstream modbus devices
+type Gateway interface {
+	// Check if requests for unit ID are forwarded
+	HasRoute(unitID byte) bool
+
+	// Forward request to downstream device, response has transaction ID of request, gateway exceptions are returned
+	// if device is unreachable (GatewayPathUnavailable) or it does not respond (GatewayTargetDeviceFailedToRespond)
+	Forward(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	// Set logger, see @Logger (call it before gateway is used)
+	SetLogger(logger Logger)
+
+	// Close connections to downstream devices
+	Close() (err error)
+}
+
+// GatewayRoute to downstream device, see example conf.json.comment file
+type GatewayRoute struct {
+	// Forwarded unit IDs, they are sent to device unchanged (devices on serial line are distinguished by them)
+	UnitIDs []int
+	// Modbus TCP device ("host:port") or serial line of modbus RTU devices (only one of them)
+	Address  string
+	Serial   string
+	BaudRate int
+	// Timeout of forwarded request in milliseconds (optional, see @DefaultClientTimeout)
+	Timeout int
+}
+
+// GatewayJSON is part of config file with gateway routes, see example conf.json.comment file
+type GatewayJSON struct {
+	GatewayRoutes []GatewayRoute
+}
+
+type gateway struct {
+	// map[unitID] = client of downstream device
+	routes  map[byte]Client
+	clients deviceClients
+	logger  Logger
+}
+
+// NewGateway creates gateway according to "GatewayRoutes" in config file, nothing is forwarded if there are no routes
+func NewGateway(config string) (Gateway, error) {
+
+	file, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mapp GatewayJSON
+	if err = json.NewDecoder(file).Decode(&mapp); err != nil {
+		return nil, err
+	}
+
+	g := &gateway{routes: make(map[byte]Client), logger: defaultLogger}
+	if len(mapp.GatewayRoutes) == 0 {
+		return g, nil
+	}
+
+	// Unit IDs mapped to smart meter can not be forwarded
+	cfg, err := LoadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	mapped := make(map[int]bool)
+	for _, device := range cfg.Devices {
+		mapped[device.UnitID] = true
+	}
+
+	for i, route := range mapp.GatewayRoutes {
+		if len(route.UnitIDs) == 0 {
+			g.Close()
+			return nil, fmt.Errorf("modbus: GatewayRoutes[%d]: UnitIDs are empty", i)
+		}
+
+		cl, err := g.clients.client(route.Address, route.Serial, route.BaudRate)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("modbus: GatewayRoutes[%d]: %v", i, err)
+		}
+		if route.Timeout > 0 {
+			cl.SetTimeout(time.Duration(route.Timeout) * time.Millisecond)
+		}
+
+		for _, unitID := range route.UnitIDs {
+			switch {
+			case unitID < 1 || unitID > 0xFF:
+				err = fmt.Errorf("modbus: GatewayRoutes[%d]: UnitID %d out of range", i, unitID)
+			case mapped[unitID]:
+				err = fmt.Errorf("modbus: GatewayRoutes[%d]: UnitID %d is mapped to smart meter", i, unitID)
+			case g.routes[byte(unitID)] != nil:
+				err = fmt.Errorf("modbus: GatewayRoutes[%d]: UnitID %d has more routes", i, unitID)
+			}
+			if err != nil {
+				g.Close()
+				return nil, err
+			}
+			g.routes[byte(unitID)] = cl
+		}
+	}
+
+	return g, nil
+}
+
+func (g *gateway) SetLogger(logger Logger) {
+	g.logger = logger
+}
+
+func (g *gateway) HasRoute(unitID byte) bool {
+	return g.routes[unitID] != nil
+}
+
+func (g *gateway) Forward(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	errHandler.FunctionCode = aduUnit.functionCode
+	l := g.logger.With(F("tid", aduUnit.transactionID), F("unit", aduUnit.unitID), F("fc", aduUnit.functionCode))
+
+	cl := g.routes[aduUnit.unitID]
+	if cl == nil {
+		l.Warn("No route to unit")
+		errHandler.ExceptionCode = ExceptionCodeGatewayPathUnavailable
+		return nil, errHandler
+	}
+
+	// Connection is opened (again) before forwarding, so unreachable device is distinguished from device which does not respond
+	if err := cl.Connect(); err != nil {
+		l.Warn("Downstream device is unreachable", F("error", err))
+		errHandler.ExceptionCode = ExceptionCodeGatewayPathUnavailable
+		return nil, errHandler
+	}
+
+	l.Debug("Forwarding request", F("data", aduUnit.data))
+	data, err := cl.Send(aduUnit.unitID, aduUnit.functionCode, aduUnit.data)
+	if err != nil {
+		// Exception of downstream device is passed to client
+		if exception, ok := err.(ErrorHandler); ok {
+			l.Debug("Downstream exception", F("exception", exception.ExceptionCode))
+			return nil, exception
+		}
+		l.Warn("Downstream device failed to respond", F("error", err))
+		errHandler.ExceptionCode = ExceptionCodeGatewayTargetDeviceFailedToRespond
+		return nil, errHandler
+	}
+
+	// Response of downstream device with transaction ID (and protocol ID) of request
+	forwarded := ADUUnit{transactionID: aduUnit.transactionID, protocolID: aduUnit.protocolID, unitID: aduUnit.unitID,
+		functionCode: aduUnit.functionCode, data: data}
+	return forwarded.encode(), errHandler
+}
+
+func (g *gateway) Close() (err error) {
+	for _, cl := range g.routes {
+		if e := cl.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	g.clients.close()
+	return err
+}
+
+// SetGateway forwards requests for unit IDs with route to downstream devices, see @Gateway (call it before server starts)
+func (s *server) SetGateway(gateway Gateway) {
+	s.gateway = gateway
+}
@@ -0,0 +1,151 @@
+package modbus
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// OverflowPolicies for connections over limits, see @Limits
+const (
+	// Connection is closed immediately
+	OverflowReject = 0
+	// First request is answered by ServerDeviceBusy exception, then connection is closed
+	OverflowBusy = 1
+)
+
+// overflowReadTimeout is used for reading request of connection over limits if read timeout is not set
+const overflowReadTimeout = time.Second
+
+// errConnLimit is returned by addHandler if connection is over limits
+var errConnLimit = errors.New("modbus: too many connections")
+
+// Limits of TCP (TLS) server connections, zero values mean no limit
+type Limits struct {
+	// Max number of concurrent connections
+	MaxConns int
+	// Max number of concurrent connections from one IP address
+	MaxConnsPerIP int
+	// Connection is closed if next request does not start within this time
+	IdleTimeout time.Duration
+	// Max time for receiving rest of started request
+	ReadTimeout time.Duration
+	// Max time for sending response
+	WriteTimeout time.Duration
+	// Handling of connections over limits, see @OverflowPolicy consts
+	OverflowPolicy int
+}
+
+// SetLimits sets limits of connections
+func (s *server) SetLimits(limits Limits) {
+	s.limits = limits
+}
+
+// checkLimits checks if there is place for one more connection from host, it must be called with locked mutex
+func (s *server) checkLimits(host string) bool {
+	if s.limits.MaxConns > 0 && len(s.conns) >= s.limits.MaxConns {
+		s.logger.Warn("Connection rejected, max number of connections reached", F("remote", host), F("max", s.limits.MaxConns))
+		return false
+	}
+	if s.limits.MaxConnsPerIP > 0 && s.hostConns[host] >= s.limits.MaxConnsPerIP {
+		s.logger.Warn("Connection rejected, max number of connections per IP reached", F("remote", host), F("max", s.limits.MaxConnsPerIP))
+		return false
+	}
+	return true
+}
+
+// rejectClient handles connection over limits according to overflow policy
+func (s *server) rejectClient(c net.Conn) {
+
+	if s.limits.OverflowPolicy != OverflowBusy {
+		return
+	}
+
+	timeout := s.limits.ReadTimeout
+	if timeout == 0 {
+		timeout = overflowReadTimeout
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+
+	framer := s.newFramer(c)
+	data, err := framer.ReadADU()
+	if err != nil {
+		return
+	}
+
+	var request ADUUnit
+	if errHandler := s.ParseRequest(data, &request); errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return
+	}
+
+	errHandler := ErrorHandler{FunctionCode: request.functionCode, ExceptionCode: ExceptionCodeServerDeviceBusy}
+	s.Write(framer, s.ResponseException(&request, errHandler))
+}
+
+// hostOf gets IP address of remote side of connection
+func hostOf(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// timeoutConn sets deadlines of connection before each read (write), implements net.Conn interface
+type timeoutConn struct {
+	net.Conn
+	s *server
+	// Some data of current request were already received (read timeout is used instead of idle timeout)
+	started bool
+}
+
+// nextRequest is called before reading of each request
+func (c *timeoutConn) nextRequest() {
+	c.started = false
+}
+
+/**
+* Read sets idle timeout while next request is awaited and read timeout once when first data of request come,
+* so slowly sending client can not extend it
+ */
+func (c *timeoutConn) Read(b []byte) (n int, err error) {
+
+	if !c.started {
+		c.setReadDeadline(c.s.limits.IdleTimeout)
+	}
+
+	n, err = c.Conn.Read(b)
+	if n > 0 && !c.started {
+		c.started = true
+		c.setReadDeadline(c.s.limits.ReadTimeout)
+	}
+	return n, err
+}
+
+// setReadDeadline sets deadline after timeout, zero timeout clears deadline (it is not limited)
+func (c *timeoutConn) setReadDeadline(timeout time.Duration) {
+
+	// No deadline is set if there are no timeouts
+	if c.s.limits.IdleTimeout == 0 && c.s.limits.ReadTimeout == 0 {
+		return
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	// Deadline set by Shutdown is kept
+	c.s.mu.Lock()
+	if !c.s.closed {
+		c.Conn.SetReadDeadline(deadline)
+	}
+	c.s.mu.Unlock()
+}
+
+func (c *timeoutConn) Write(b []byte) (n int, err error) {
+	if c.s.limits.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.s.limits.WriteTimeout))
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,93 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dialTestServer connects to local server, connection is closed at the end of test
+func dialTestServer(t *testing.T, port int) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+// isClosed checks if server closed connection (read returns error before deadline)
+func isClosed(c net.Conn, wait time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, err := c.Read(make([]byte, MaxADULength))
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestLimitsTimeouts(t *testing.T) {
+	request := mbap(1, 1, FuncCodeReadHoldingRegisters, 0, 104, 0, 1)
+	response := mbap(1, 1, FuncCodeReadHoldingRegisters, 2, 0, 7)
+
+	tests := []struct {
+		name   string
+		limits Limits
+		// Pause before second request
+		idle time.Duration
+		// Pause between bytes of second request
+		pause  time.Duration
+		closed bool
+	}{
+		{"read timeout does not limit idle connection", Limits{ReadTimeout: 100 * time.Millisecond}, 300 * time.Millisecond, 0, false},
+		{"idle timeout", Limits{IdleTimeout: 100 * time.Millisecond}, 300 * time.Millisecond, 0, true},
+		{"request within read timeout", Limits{IdleTimeout: time.Second, ReadTimeout: 300 * time.Millisecond}, 0, 10 * time.Millisecond, false},
+		{"slow request", Limits{ReadTimeout: 200 * time.Millisecond}, 0, 50 * time.Millisecond, true},
+		{"slow request without limits", Limits{}, 0, 30 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sm := newTestSmartMeter(t)
+			sm.WriteValues("Node1/count", "7")
+			_, port := startTestServer(t, sm, func(s Server) {
+				s.SetLimits(test.limits)
+			})
+			c := dialTestServer(t, port)
+
+			// First request is fragmented, so read timeout is set during it
+			c.Write(request[:5])
+			time.Sleep(20 * time.Millisecond)
+			if got := exchange(t, c, request[5:]); !bytes.Equal(got, response) {
+				t.Fatalf("response % X, want % X", got, response)
+			}
+			time.Sleep(test.idle)
+
+			c.SetDeadline(time.Time{})
+			for i := range request {
+				if _, err := c.Write(request[i : i+1]); err != nil {
+					break
+				}
+				time.Sleep(test.pause)
+			}
+
+			if test.closed {
+				if !isClosed(c, time.Second) {
+					t.Error("connection is not closed")
+				}
+				return
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			got := make([]byte, MaxADULength)
+			n, err := c.Read(got)
+			if err != nil || !bytes.Equal(got[:n], response) {
+				t.Errorf("response % X, error %v", got[:n], err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package modbus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// LogLevels of Logger messages
+const (
+	LevelDebug = 0
+	LevelInfo  = 1
+	LevelWarn  = 2
+	LevelError = 3
+)
+
+var levelNames = map[int]string{LevelDebug: "DEBUG", LevelInfo: "INFO", LevelWarn: "WARN", LevelError: "ERROR"}
+
+// Field is structured data of log message, i.e. remote address, transaction ID, unit ID, function code or topic
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates field of log message
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger with levels and structured fields, used by server, smart meter and MQTT client
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+
+	// Logger adding fields to each message
+	With(fields ...Field) Logger
+
+	// Check if messages of level are logged (to skip costly preparation of debug data)
+	Enabled(level int) bool
+}
+
+// stdLogger writes messages by standard log package as "LEVEL message key=value ...", implements Logger interface
+type stdLogger struct {
+	out    *log.Logger
+	level  int
+	fields []Field
+}
+
+// NewLogger creates logger writing messages of level and higher to w
+func NewLogger(w io.Writer, level int) Logger {
+	return &stdLogger{out: log.New(w, "", log.LstdFlags), level: level}
+}
+
+// defaultLogger is used by new components and by framers created outside of server or client, see @SetDefaultLogger
+var defaultLogger = NewLogger(os.Stderr, LevelInfo)
+
+// SetDefaultLogger sets logger of components created later (call it before anything is created)
+func SetDefaultLogger(logger Logger) {
+	defaultLogger = logger
+}
+
+// ParseLevel gets log level from its name (debug, info, warn or error)
+func ParseLevel(name string) (level int, err error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("modbus: unknown log level %q", name)
+}
+
+func (l *stdLogger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *stdLogger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *stdLogger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *stdLogger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *stdLogger) With(fields ...Field) Logger {
+	return &stdLogger{out: l.out, level: l.level, fields: append(append([]Field(nil), l.fields...), fields...)}
+}
+
+func (l *stdLogger) Enabled(level int) bool {
+	return level >= l.level
+}
+
+func (l *stdLogger) log(level int, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var line bytes.Buffer
+	line.WriteString(levelNames[level])
+	line.WriteByte(' ')
+	line.WriteString(msg)
+	for _, field := range l.fields {
+		fmt.Fprintf(&line, " %s=%v", field.Key, field.Value)
+	}
+	for _, field := range fields {
+		fmt.Fprintf(&line, " %s=%v", field.Key, field.Value)
+	}
+	l.out.Println(line.String())
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/foxconn4tech/modbus"
@@ -16,8 +21,61 @@ func main() {
 	port := flag.Int("port", 0, "The port for listening")
 	// Config json file specifying smart meter mappings, see @conf.json file
 	configFile := flag.String("config", "", "The json config file")
+	// Optional serial line for modbus RTU slave (baud rate must be set on the line, i.e. by stty)
+	serialPort := flag.String("serial", "", "The serial line for modbus RTU server, i.e. /dev/ttyUSB0 (optional)")
+	baudRate := flag.Int("baud", 9600, "The baud rate of serial line")
+	// Framing of TCP connections
+	framing := flag.String("framing", "mbap", "The framing of TCP connections: mbap, rtu (RTU over TCP) or ascii")
+	// Modbus UDP server on the same address and port
+	udp := flag.Bool("udp", false, "Start also modbus UDP server")
+	// Modbus/TCP security server (roles are read from config file)
+	tlsCert := flag.String("tls-cert", "", "The server certificate for modbus/TCP security server (optional)")
+	tlsKey := flag.String("tls-key", "", "The key of server certificate")
+	tlsCA := flag.String("tls-ca", "", "The CA certificate for client certificates verification")
+	tlsPort := flag.Int("tls-port", modbus.DefaultTLSPort, "The port for modbus/TCP security server")
+	// Limits of TCP (TLS) connections, 0 means no limit
+	maxConns := flag.Int("max-conns", 0, "The max number of concurrent connections")
+	maxConnsPerIP := flag.Int("max-conns-ip", 0, "The max number of concurrent connections from one IP address")
+	idleTimeout := flag.Duration("idle-timeout", 0, "The connection is closed if no request comes within this time, i.e. 60s")
+	readTimeout := flag.Duration("read-timeout", 0, "The max time for receiving rest of request, i.e. 5s")
+	writeTimeout := flag.Duration("write-timeout", 0, "The max time for sending response, i.e. 5s")
+	overflow := flag.String("overflow", "reject", "The handling of connections over limits: reject or busy (ServerDeviceBusy exception)")
+	// Level of logged messages
+	logLevel := flag.String("loglevel", "info", "The log level: debug, info, warn or error")
+	// Optional HTTP endpoint with Prometheus metrics
+	metricsAddr := flag.String("metrics", "", "The listening address of metrics endpoint /metrics, i.e. :9100 (optional)")
+	// Conversion of config file with legacy layout (parallel arrays) to structured layout
+	convertTo := flag.String("convert", "", "Convert legacy config file (-config) to structured layout, write it to this file and exit")
 	flag.Parse()
 
+	// Logger is used by all modbus components
+	level, err := modbus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Println("Unknown log level, use debug, info, warn or error for -loglevel setting")
+		return
+	}
+	logger := modbus.NewLogger(os.Stderr, level)
+	modbus.SetDefaultLogger(logger)
+
+	// Convert config file only
+	if *convertTo != "" {
+		if *configFile == "" {
+			log.Println("The config file is not specified, use -config setting")
+			return
+		}
+		data, err := modbus.ConvertConfig(*configFile)
+		if err != nil {
+			logger.Error("Config file was not succesfully converted", modbus.F("error", err))
+			return
+		}
+		if err := os.WriteFile(*convertTo, data, 0644); err != nil {
+			logger.Error("Converted config file was not succesfully written", modbus.F("error", err))
+			return
+		}
+		logger.Info("Config file converted", modbus.F("file", *convertTo))
+		return
+	}
+
 	// Check parameters
 	if *addr == "" {
 		log.Println("The server address is empty, use -ip setting")
@@ -34,42 +92,106 @@ func main() {
 		return
 	}
 
-	if modbus.LoggerEnable == true {
-		log.Println("Loading config file...")
+	framingModes := map[string]int{"mbap": modbus.FramingMBAP, "rtu": modbus.FramingRTUOverTCP, "ascii": modbus.FramingASCII}
+	framingMode, ok := framingModes[*framing]
+	if !ok {
+		log.Println("Unknown framing, use mbap, rtu or ascii for -framing setting")
+		return
 	}
 
-	// Create smart meter with settings according to config file
-	smartMeter := modbus.NewSmartMeter(*configFile)
-	if smartMeter == nil {
-		log.Println("Config file was not succefully loaded")
+	overflowPolicies := map[string]int{"reject": modbus.OverflowReject, "busy": modbus.OverflowBusy}
+	overflowPolicy, ok := overflowPolicies[*overflow]
+	if !ok {
+		log.Println("Unknown overflow policy, use reject or busy for -overflow setting")
 		return
 	}
 
-	if modbus.LoggerEnable == true {
-		log.Println(smartMeter)
+	logger.Debug("Loading config file...")
+
+	// Create smart meter with settings according to config file, all invalid items of config are reported
+	var smartMeter modbus.SmartMeter
+	config, err := modbus.LoadConfig(*configFile)
+	if err == nil && (*serialPort != "" || framingMode != modbus.FramingMBAP) {
+		// Unit ID 0 is broadcast in RTU and ASCII, requests to it would be never answered
+		err = config.ValidateSerial()
+	}
+	if err == nil {
+		smartMeter, err = modbus.NewSmartMeterFromConfig(config)
 	}
+	if err != nil {
+		if errs, ok := err.(modbus.ConfigErrors); ok {
+			for _, e := range errs {
+				logger.Error("Invalid config file", modbus.F("path", e.Path), modbus.F("error", e.Message))
+			}
+		} else {
+			logger.Error("Config file was not succefully loaded", modbus.F("error", err))
+		}
+		return
+	}
+
+	logger.Debug("Smart meter loaded", modbus.F("config", *configFile))
 
 	// Channel for communication among mqtt client and smart meter storage
 	// process: incoming mqqt message -> send it to this channel -> channel sends value to smart meter -> smart meter stores this value
 	chanBridge := make(chan [2]string)
 
+	// Channel for commands written by modbus clients
+	// process: modbus write request -> smart meter sends command to this channel -> mqtt client publishes it
+	chanCommand := make(chan [2]string, 64)
+	smartMeter.SetCommandChannel(chanCommand)
+
 	// New MQTT client
 	// TODO make it configurable //"tcp://iot.eclipse.org:1883"
 	//mqttClient := modbus.NewMqttClient("/modbus/#", "tcp://eu.thethings.network:1883", "testmodid123", "sdf654sdf", "ttn-account-v2.VzKrXNILq_3NUBtVaGgH2baGYSm60I7Blr6HMAd8VeE", "sub", 0)
 	mqttClient := modbus.NewMqttClient("/modbus/#", "tcp://172.18.0.2:1883", "testmodid123", "", "", "sub", 0)
 
+	// Metrics of servers and mqtt client
+	var metrics modbus.Metrics
+	if *metricsAddr != "" {
+		metrics = modbus.NewMetrics(smartMeter)
+		mqttClient.SetMetrics(metrics)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			logger.Info("Metrics endpoint starts.................", modbus.F("addr", *metricsAddr))
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				logger.Error("Metrics endpoint stopped", modbus.F("error", err))
+			}
+		}()
+	}
+
 	// Start client (pub and sub)
 	go mqttClient.SetMQTTPub()
 	go mqttClient.StartMQTTSub(chanBridge)
+	go mqttClient.StartMQTTPub(chanCommand)
+
+	// Poll downstream modbus devices and publish their values through mqtt publisher
+	poller, err := modbus.NewPoller(*configFile)
+	if err != nil {
+		logger.Error("Polled devices were not succesfully loaded", modbus.F("error", err))
+		return
+	}
+
+	// Channel of polled values has its own publisher, so polling can not fill command channel of smart meter
+	// process: poller reads downstream device -> poller sends values to this channel -> mqtt client publishes them
+	chanPoll := make(chan [2]string, 64)
+	pollClient := modbus.NewMqttClient("/modbus/#", "tcp://172.18.0.2:1883", "testmodid123-poll", "", "", "pub", 0)
+	if metrics != nil {
+		pollClient.SetMetrics(metrics)
+	}
+	go pollClient.StartMQTTPub(chanPoll)
+
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	defer stopPolling()
+	go poller.Start(pollCtx, chanPoll)
 
 	// Start function that is waiting for incoming request through channel and then stores it
 	go func() {
 		for {
 			incoming := <-chanBridge
 
-			if modbus.LoggerEnable == true {
-				log.Println("Writing values: ", incoming)
-			}
+			logger.Debug("Writing values", modbus.F("topic", incoming[0]), modbus.F("value", incoming[1]))
 
 			// Topics are usually in this format "/root/level1/level2"
 			topics := strings.Split(incoming[0], "/")
@@ -77,7 +199,7 @@ func main() {
 
 			// Check if the length of topics (ie. numbur of levels separated by "/") is enough
 			if topicsNum < 3 {
-				log.Printf("Invalid topic length (%d)\n", topicsNum)
+				logger.Warn("Invalid topic length", modbus.F("topic", incoming[0]), modbus.F("length", topicsNum))
 				continue
 			}
 
@@ -89,20 +211,96 @@ func main() {
 			if strings.HasPrefix(nodeID, "Node") {
 				smartMeter.WriteValues(nodeID+"/"+topic, incoming[1])
 			} else {
-				log.Println("Invalid node id for received topic")
+				logger.Warn("Invalid node id for received topic", modbus.F("topic", incoming[0]))
 			}
 		}
 	}()
 
+	// Unit IDs not mapped to smart meter can be forwarded to downstream modbus devices
+	gateway, err := modbus.NewGateway(*configFile)
+	if err != nil {
+		logger.Error("Gateway routes were not succesfully loaded", modbus.F("error", err))
+		return
+	}
+	defer gateway.Close()
+
+	// Initialize and start modbus RTU server, if serial line is set
+	var rtuServer modbus.Server
+	if *serialPort != "" {
+		port, err := os.OpenFile(*serialPort, os.O_RDWR, 0)
+		if err != nil {
+			logger.Error("Serial line was not succesfully opened", modbus.F("error", err))
+			return
+		}
+		defer port.Close()
+
+		rtuServer = modbus.NewRTUServer(port, *baudRate, smartMeter)
+		rtuServer.SetMetrics(metrics)
+		rtuServer.SetGateway(gateway)
+		logger.Info("RTU server starts.................")
+		go rtuServer.ServerStart()
+	}
+
 	// Initialize and start modbus TCP server
 	server := modbus.NewTCPServer(*port, *addr, smartMeter)
 	if server == nil {
-		log.Println("Server was not succesfully initialize")
+		logger.Error("Server was not succesfully initialize")
 		return
 	}
-	log.Println("Server starts.................")
-	server.ServerStart()
+	server.SetFraming(framingMode)
+	server.SetMetrics(metrics)
+	server.SetGateway(gateway)
+	accessControl, err := modbus.NewAccessControl(*configFile)
+	if err != nil {
+		logger.Error("Access rules were not succesfully loaded", modbus.F("error", err))
+		return
+	}
+	server.SetAccessControl(accessControl)
+	server.SetLimits(modbus.Limits{
+		MaxConns:       *maxConns,
+		MaxConnsPerIP:  *maxConnsPerIP,
+		IdleTimeout:    *idleTimeout,
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+		OverflowPolicy: overflowPolicy,
+	})
+	if *udp {
+		logger.Info("UDP server starts.................")
+		go server.ServerStartUDP()
+	}
+	if *tlsCert != "" {
+		roles, err := modbus.LoadTLSRoles(*configFile)
+		if err != nil {
+			logger.Error("TLS roles were not succesfully loaded", modbus.F("error", err))
+			return
+		}
+		logger.Info("TLS server starts.................")
+		go server.ServerStartTLS(modbus.TLSConfig{Port: *tlsPort, CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, Roles: roles})
+	}
+	logger.Info("Server starts.................")
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- server.ServerStart()
+	}()
 
-	//TMP waiting feature
-	time.Sleep(10 * time.Second)
+	// Run until server fails or it is stopped by signal (i.e. by supervisor)
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-chanErr:
+		logger.Error("Server stopped", modbus.F("error", err))
+	case sig := <-chanSignal:
+		logger.Info("Server stops.................", modbus.F("signal", sig))
+		// Requests in progress are finished, connections are closed then
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if rtuServer != nil {
+			if err := rtuServer.Shutdown(ctx); err != nil {
+				logger.Warn("RTU server shutdown error", modbus.F("error", err))
+			}
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Server shutdown error", modbus.F("error", err))
+		}
+	}
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/foxconn4tech/modbus"
@@ -50,25 +54,28 @@ func startModbusServer() {
 	ModbusClientaddr := cmd.Get("ModbusClientaddr").MustString()
 	ModbusClientport := cmd.Get("ModbusClientport").MustString()
 
-	if modbus.LoggerEnable == true {
-		log.Println("Loading config file...")
-	}
+	// Logger of modbus components, values written from MQTT are logged at debug level
+	logger := modbus.NewLogger(os.Stderr, modbus.LevelInfo)
+	modbus.SetDefaultLogger(logger)
+
+	log.Println("Loading config file...")
 
 	// Create smart meter with settings according to config file
-	smartMeter := modbus.NewSmartMeter(configFile)
-	if smartMeter == nil {
-		log.Println("Config file was not succefully loaded")
+	smartMeter, err := modbus.NewSmartMeter(configFile)
+	if err != nil {
+		log.Println("Config file was not succefully loaded:", err)
 		return
 	}
 
-	if modbus.LoggerEnable == true {
-		log.Println(smartMeter)
-	}
-
 	// Channel for communication among mqtt client and smart meter storage
 	// process: incoming mqqt message -> send it to this channel -> channel sends value to smart meter -> smart meter stores this value
 	chanBridge := make(chan [2]string)
 
+	// Channel for commands written by modbus clients
+	// process: modbus write request -> smart meter sends command to this channel -> mqtt client publishes it
+	chanCommand := make(chan [2]string, 64)
+	smartMeter.SetCommandChannel(chanCommand)
+
 	// New MQTT client
 	// TODO make it configurable //"tcp://iot.eclipse.org:1883"
 	//mqttClient := modbus.NewMqttClient("/modbus/#", "tcp://eu.thethings.network:1883", "testmodid123", "sdf654sdf", "ttn-account-v2.VzKrXNILq_3NUBtVaGgH2baGYSm60I7Blr6HMAd8VeE", "sub", 0)
@@ -77,15 +84,14 @@ func startModbusServer() {
 	// Start client (pub and sub)
 	go mqttClient.SetMQTTPub()
 	go mqttClient.StartMQTTSub(chanBridge)
+	go mqttClient.StartMQTTPub(chanCommand)
 
 	// Start function that is waiting for incoming request through channel and then stores it
 	go func() {
 		for {
 			incoming := <-chanBridge
 
-			if modbus.LoggerEnable == true {
-				log.Println("Writing values: ", incoming)
-			}
+			logger.Debug("Writing values", modbus.F("topic", incoming[0]), modbus.F("value", incoming[1]))
 
 			// Topics are usually in this format "/root/level1/level2"
 			topics := strings.Split(incoming[0], "/")
@@ -93,7 +99,7 @@ func startModbusServer() {
 
 			// Check if the length of topics (ie. numbur of levels separated by "/") is enough
 			if topicsNum < 3 {
-				log.Printf("Invalid topic length (%d)\n", topicsNum)
+				logger.Warn("Invalid topic length", modbus.F("topic", incoming[0]), modbus.F("length", topicsNum))
 				continue
 			}
 
@@ -105,7 +111,7 @@ func startModbusServer() {
 			if strings.HasPrefix(nodeID, "Node") {
 				smartMeter.WriteValues(nodeID+"/"+topic, incoming[1])
 			} else {
-				log.Println("Invalid node id for received topic")
+				logger.Warn("Invalid node id for received topic", modbus.F("topic", incoming[0]))
 			}
 		}
 	}()
@@ -117,10 +123,26 @@ func startModbusServer() {
 		return
 	}
 	log.Println("Server starts.................")
-	server.ServerStart()
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- server.ServerStart()
+	}()
 
-	//TMP waiting feature
-	time.Sleep(10 * time.Second)
+	// Run until server fails or it is stopped by signal (i.e. by supervisor)
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-chanErr:
+		logger.Error("Server stopped", modbus.F("error", err))
+	case sig := <-chanSignal:
+		logger.Info("Server stops.................", modbus.F("signal", sig))
+		// Requests in progress are finished, connections are closed then
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Server shutdown error", modbus.F("error", err))
+		}
+	}
 }
 
 func main() {
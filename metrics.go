@@ -0,0 +1,200 @@
+package modbus
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are upper bounds (in seconds) of response latency histogram
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics of bridge, served in Prometheus text format by ServeHTTP
+type Metrics interface {
+	http.Handler
+
+	// Record handled request, exceptionCode is code sent to client (0 for success)
+	ObserveRequest(unitID byte, functionCode byte, exceptionCode byte, latency time.Duration)
+
+	// Record opened (closed) TCP connection
+	ConnOpened()
+	ConnClosed()
+
+	// Record MQTT message received for node
+	MQTTMessage(nodeID string)
+
+	// Record reconnection of MQTT client
+	MQTTReconnect()
+}
+
+// requestKey is label pair of requests counter
+type requestKey struct {
+	unitID       byte
+	functionCode byte
+}
+
+type metrics struct {
+	mu sync.Mutex
+
+	requests   map[requestKey]uint64
+	exceptions map[byte]uint64
+	// Latency histogram, counts are not cumulative (last one is +Inf bucket)
+	latencyCounts []uint64
+	latencySum    float64
+	latencyCount  uint64
+
+	connections    int64
+	mqttMessages   map[string]uint64
+	mqttReconnects uint64
+
+	// Source of value ages, see @SmartMeter.GetValueAges
+	sm SmartMeter
+}
+
+// NewMetrics creates metrics, value ages are read from smart meter (it can be nil)
+func NewMetrics(sm SmartMeter) Metrics {
+	return &metrics{requests: make(map[requestKey]uint64), exceptions: make(map[byte]uint64), latencyCounts: make([]uint64, len(latencyBuckets)+1),
+		mqttMessages: make(map[string]uint64), sm: sm}
+}
+
+func (m *metrics) ObserveRequest(unitID byte, functionCode byte, exceptionCode byte, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{unitID: unitID, functionCode: functionCode}]++
+	if exceptionCode != ExceptionCodeSuccess {
+		m.exceptions[exceptionCode]++
+	}
+
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+	m.latencyCounts[bucket]++
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+func (m *metrics) ConnOpened() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+}
+
+func (m *metrics) ConnClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections--
+}
+
+func (m *metrics) MQTTMessage(nodeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mqttMessages[nodeID]++
+}
+
+func (m *metrics) MQTTReconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mqttReconnects++
+}
+
+// ServeHTTP writes all metrics in Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	var out strings.Builder
+
+	m.mu.Lock()
+
+	out.WriteString("# HELP modbus_requests_total Handled modbus requests.\n# TYPE modbus_requests_total counter\n")
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].unitID != requestKeys[j].unitID {
+			return requestKeys[i].unitID < requestKeys[j].unitID
+		}
+		return requestKeys[i].functionCode < requestKeys[j].functionCode
+	})
+	for _, key := range requestKeys {
+		fmt.Fprintf(&out, "modbus_requests_total{unit_id=\"%d\",function_code=\"%d\"} %d\n", key.unitID, key.functionCode, m.requests[key])
+	}
+
+	out.WriteString("# HELP modbus_exceptions_total Exception responses by exception code.\n# TYPE modbus_exceptions_total counter\n")
+	codes := make([]int, 0, len(m.exceptions))
+	for code := range m.exceptions {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&out, "modbus_exceptions_total{exception_code=\"%d\"} %d\n", code, m.exceptions[byte(code)])
+	}
+
+	out.WriteString("# HELP modbus_response_duration_seconds Time from receiving request to sending response.\n# TYPE modbus_response_duration_seconds histogram\n")
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += m.latencyCounts[i]
+		fmt.Fprintf(&out, "modbus_response_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(&out, "modbus_response_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(&out, "modbus_response_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(&out, "modbus_response_duration_seconds_count %d\n", m.latencyCount)
+
+	out.WriteString("# HELP modbus_active_connections Open TCP connections.\n# TYPE modbus_active_connections gauge\n")
+	fmt.Fprintf(&out, "modbus_active_connections %d\n", m.connections)
+
+	out.WriteString("# HELP modbus_mqtt_messages_received_total MQTT messages received per node.\n# TYPE modbus_mqtt_messages_received_total counter\n")
+	writeLabeled(&out, "modbus_mqtt_messages_received_total", "node", m.mqttMessages)
+
+	out.WriteString("# HELP modbus_mqtt_reconnects_total Reconnections of MQTT client.\n# TYPE modbus_mqtt_reconnects_total counter\n")
+	fmt.Fprintf(&out, "modbus_mqtt_reconnects_total %d\n", m.mqttReconnects)
+
+	m.mu.Unlock()
+
+	if m.sm != nil {
+		out.WriteString("# HELP modbus_value_age_seconds Time since value of topic was received.\n# TYPE modbus_value_age_seconds gauge\n")
+		ages := m.sm.GetValueAges()
+		topics := make([]string, 0, len(ages))
+		for topic := range ages {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			fmt.Fprintf(&out, "modbus_value_age_seconds{topic=\"%s\"} %g\n", escapeLabel(topic), ages[topic].Seconds())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(out.String()))
+}
+
+// writeLabeled writes counter with one label sorted by label value
+func writeLabeled(out *strings.Builder, name string, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(key), values[key])
+	}
+}
+
+// escapeLabel escapes label value for text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// SetMetrics sets metrics of server, nil disables them
+func (s *server) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+// observe records request in metrics
+func (s *server) observe(request *ADUUnit, errHandler ErrorHandler, start time.Time) {
+	if s.metrics != nil {
+		s.metrics.ObserveRequest(request.unitID, request.functionCode, WireExceptionCode(errHandler.ExceptionCode), time.Since(start))
+	}
+}
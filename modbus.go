@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"context"
 	"net"
 )
 
@@ -10,9 +11,15 @@ const (
 	FuncCodeReadDiscreteInputs = 2
 	FuncCodeReadCoils          = 1
 
+	FuncCodeWriteSingleCoil    = 5
+	FuncCodeWriteMultipleCoils = 15
+
 	// 16-bit access
-	FuncCodeReadInputRegisters   = 4
-	FuncCodeReadHoldingRegisters = 3
+	FuncCodeReadInputRegisters         = 4
+	FuncCodeReadHoldingRegisters       = 3
+	FuncCodeWriteSingleRegister        = 6
+	FuncCodeWriteMultipleRegisters     = 16
+	FuncCodeReadWriteMultipleRegisters = 23
 )
 
 // ExceptionCode
@@ -29,17 +36,29 @@ const (
 	ExceptionCodeGatewayPathUnavailable             = 10
 	ExceptionCodeGatewayTargetDeviceFailedToRespond = 11
 
-	// custom exceptions
+	// custom exceptions (never sent as they are, see @WireExceptionCode)
 	ExceptionCodeCreationError = 0xE1
 	ExceptionCodeBadUnitID     = 0xE2
+	ExceptionCodeValueOverflow = 0xE3
 )
 
+// WireExceptionCode converts exception code to the one sent to the client, custom exceptions are mapped to standard ones
+func WireExceptionCode(exceptionCode byte) byte {
+	switch exceptionCode {
+	case ExceptionCodeCreationError, ExceptionCodeValueOverflow:
+		// Response could not be created from stored value (or value does not fit to register)
+		return ExceptionCodeServerDeviceFailure
+	case ExceptionCodeBadUnitID:
+		// There is no smart meter mapped behind this unit ID
+		return ExceptionCodeGatewayPathUnavailable
+	default:
+		return exceptionCode
+	}
+}
+
 // MaxADULength for modbus tcp
 const MaxADULength = 260
 
-// LoggerEnable - set if logger should be enable
-const LoggerEnable = true
-
 // ErrorHandler for handling modbus errors
 type ErrorHandler struct {
 	FunctionCode  byte
@@ -63,13 +82,40 @@ type Server interface {
 	// Start Server
 	ServerStart() (err error)
 
+	// Start UDP Server (on the same address and port)
+	ServerStartUDP() (err error)
+
+	// Start modbus/TCP security server (TLS with client certificates)
+	ServerStartTLS(config TLSConfig) (err error)
+
+	// Stop accepting, wait for requests in progress and close connections (forcibly if ctx is done first), ServerStart functions return ErrServerClosed
+	Shutdown(ctx context.Context) (err error)
+
+	// Set framing mode of connections, see @FramingMode consts (call it before server starts)
+	SetFraming(mode int)
+
+	// Set limits of connections (call it before server starts)
+	SetLimits(limits Limits)
+
+	// Set access control of clients (call it before server starts)
+	SetAccessControl(ac AccessControl)
+
+	// Set logger, see @Logger (call it before server starts)
+	SetLogger(logger Logger)
+
+	// Set gateway forwarding requests to downstream devices, see @Gateway (call it before server starts)
+	SetGateway(gateway Gateway)
+
+	// Set metrics of requests and connections, see @Metrics (call it before server starts)
+	SetMetrics(m Metrics)
+
 	HandleClient(c net.Conn)
 
-	// Default reading operation (handle request)
-	Read(c net.Conn) (err error)
+	// Default reading operation (read and handle one request from framer of connection, c is nil for serial line)
+	Read(c net.Conn, f Framer) (err error)
 
 	// Write data
-	Write(c net.Conn, data []byte) (err error)
+	Write(f Framer, data []byte) (err error)
 
 	// Parse received request from client
 	ParseRequest(adu []byte, aduUnit *ADUUnit) (errHandler ErrorHandler)
@@ -84,4 +130,19 @@ type Server interface {
 	\******************************/
 	//
 	ResponseRHRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	ResponseRIRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	ResponseCoils(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	ResponseDInputs(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	// Write single coil and write multiple coils
+	ResponseWriteCoils(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	// Write single register and write multiple registers
+	ResponseWriteRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler)
+
+	// Exception response for request which could not be served
+	ResponseException(aduUnit *ADUUnit, errHandler ErrorHandler) (response []byte)
 }
@@ -1,9 +1,10 @@
 package modbus
 
 import (
-	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -13,22 +14,56 @@ import (
 type MQTTClient interface {
 	SetMQTTPub()
 	StartMQTTSub(choke chan [2]string)
+	StartMQTTPub(chanCommand chan [2]string)
+	SetLogger(logger Logger)
+	SetMetrics(m Metrics)
 }
 
 // mqttSettings for MQTT client
 type mqttSettings struct {
-	topic  string
-	broker string
-	id     string
-	user   string
-	passwd string
-	action string
-	qos    int
+	topic   string
+	broker  string
+	id      string
+	user    string
+	passwd  string
+	action  string
+	qos     int
+	logger  Logger
+	metrics Metrics
 }
 
 // NewMqttClient - get new mqtt client with specified settings
 func NewMqttClient(topic string, broker string, id string, user string, passwd string, action string, qos int) MQTTClient {
-	return &mqttSettings{topic: topic, broker: broker, id: id, user: user, passwd: passwd, action: action, qos: qos}
+	return &mqttSettings{topic: topic, broker: broker, id: id, user: user, passwd: passwd, action: action, qos: qos, logger: defaultLogger}
+}
+
+// SetLogger sets logger of mqtt client, see @Logger
+func (mq *mqttSettings) SetLogger(logger Logger) {
+	mq.logger = logger
+}
+
+// SetMetrics sets metrics of received messages and reconnections, see @Metrics (call it before client starts)
+func (mq *mqttSettings) SetMetrics(m Metrics) {
+	mq.metrics = m
+}
+
+// countReconnects records every connection of client after the first one in metrics
+func (mq *mqttSettings) countReconnects(opts *MQTT.ClientOptions) {
+	var connects int32
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		if atomic.AddInt32(&connects, 1) > 1 && mq.metrics != nil {
+			mq.metrics.MQTTReconnect()
+		}
+	})
+}
+
+// topicNode gets node ID from topic ".../NodeID/topic"
+func topicNode(topic string) string {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 2 {
+		return ""
+	}
+	return levels[len(levels)-2]
 }
 
 // Test client for publishing
@@ -45,7 +80,7 @@ func (mq *mqttSettings) SetMQTTPub() {
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
-	fmt.Println("Sample Publisher Started")
+	mq.logger.Info("Sample Publisher Started")
 
 	ch1 := make(chan string)
 	ch2 := make(chan string)
@@ -53,7 +88,7 @@ func (mq *mqttSettings) SetMQTTPub() {
 	go func() {
 		tmp := 1
 		for i := 0; i < 10; i++ {
-			fmt.Println("---- doing publish ----")
+			mq.logger.Debug("---- doing publish ----")
 			payload := strconv.Itoa(tmp)
 			token := client.Publish("/modbus/Node1/volt1", byte(0), false, payload)
 			token.Wait()
@@ -67,7 +102,7 @@ func (mq *mqttSettings) SetMQTTPub() {
 	go func() {
 		tmp := 1
 		for i := 0; i < 10; i++ {
-			fmt.Println("---- doing publish ----")
+			mq.logger.Debug("---- doing publish ----")
 			payload := strconv.Itoa(tmp)
 			token := client.Publish("/modbus/Node1/volt4", byte(0), false, payload)
 			token.Wait()
@@ -78,11 +113,11 @@ func (mq *mqttSettings) SetMQTTPub() {
 		ch2 <- "done 2"
 	}()
 
-	fmt.Println(<-ch1)
-	fmt.Println(<-ch2)
+	mq.logger.Info(<-ch1)
+	mq.logger.Info(<-ch2)
 
 	client.Disconnect(250)
-	fmt.Println("Sample Publisher Disconnected")
+	mq.logger.Info("Sample Publisher Disconnected")
 }
 
 /**
@@ -97,6 +132,7 @@ func (mq *mqttSettings) StartMQTTSub(chanBridge chan [2]string) {
 	opts.SetClientID(mq.id)
 	opts.SetUsername(mq.user)
 	opts.SetPassword(mq.passwd)
+	mq.countReconnects(opts)
 	// opts.SetCleanSession(*cleansess)
 	// if *store != ":memory:" {
 	// 	opts.SetStore(MQTT.NewFileStore(*store))
@@ -118,7 +154,7 @@ func (mq *mqttSettings) StartMQTTSub(chanBridge chan [2]string) {
 
 	// Subscribe for specific topic
 	if token := client.Subscribe(mq.topic, byte(mq.qos), nil); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
+		mq.logger.Error("Subscribing error", F("topic", mq.topic), F("error", token.Error()))
 		os.Exit(1)
 	}
 
@@ -128,15 +164,50 @@ func (mq *mqttSettings) StartMQTTSub(chanBridge chan [2]string) {
 	num := 20
 	for receiveCount < num {
 		incoming := <-choke
-		fmt.Printf("RECEIVED TOPIC: %s MESSAGE: %s\n", incoming[0], incoming[1])
+		mq.logger.Debug("Received message", F("topic", incoming[0]), F("value", incoming[1]))
+		if mq.metrics != nil {
+			mq.metrics.MQTTMessage(topicNode(incoming[0]))
+		}
 		receiveCount++
 		// Send incoming to bridge pipe to store this data
 		chanBridge <- incoming
 	}
 
 	client.Disconnect(250)
-	fmt.Println("Sample Subscriber Disconnected")
+	mq.logger.Info("Sample Subscriber Disconnected")
+
+}
+
+/**
+* StartMQTTPub
+* @param chanCommand channel with commands (topic and payload) which should be published, typically from smart meter
+ */
+func (mq *mqttSettings) StartMQTTPub(chanCommand chan [2]string) {
+
+	// Set mqtt settings, publisher needs its own client ID
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(mq.broker)
+	opts.SetClientID(mq.id + "-pub")
+	opts.SetUsername(mq.user)
+	opts.SetPassword(mq.passwd)
+	mq.countReconnects(opts)
+
+	// Create new client and check if it was succefull
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
 
+	// Publish every incoming command
+	for command := range chanCommand {
+		mq.logger.Debug("Publishing command", F("topic", command[0]), F("value", command[1]))
+		if token := client.Publish(command[0], byte(mq.qos), false, command[1]); token.Wait() && token.Error() != nil {
+			mq.logger.Warn("Publishing error", F("topic", command[0]), F("error", token.Error()))
+		}
+	}
+
+	client.Disconnect(250)
+	mq.logger.Info("Command Publisher Disconnected")
 }
 
 // package main
@@ -0,0 +1,296 @@
+package modbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPollTopic is used for publishing polled values if config does not specify PollTopic
+const DefaultPollTopic = "/modbus/{nodeID}/{topic}"
+
+// Defaults of polling of devices
+const (
+	DefaultPollInterval = time.Second
+	DefaultMaxBackoff   = time.Minute
+)
+
+// PollDeviceJSON - downstream modbus device, see example conf.json.comment file
+type PollDeviceJSON struct {
+	NodeID string
+	// Index to Types, see @ConfigJSON.Types
+	Type   int
+	UnitID int
+	// Modbus TCP device ("host:port") or serial line of modbus RTU device (only one of them)
+	Address  string
+	Serial   string
+	BaudRate int
+	// Poll interval and max interval of polling after errors in milliseconds (optional, see @DefaultPollInterval and @DefaultMaxBackoff)
+	PollInterval int
+	MaxBackoff   int
+}
+
+// PollJSONTable is part of config file with polled devices (their types are in @ConfigJSON.Types), see example conf.json.comment file
+type PollJSONTable struct {
+	PollDevices []PollDeviceJSON
+	// Topic for publishing polled values, {nodeID} and {topic} are replaced (optional, see @DefaultPollTopic)
+	PollTopic string
+}
+
+// Poller reads registers of downstream modbus devices periodically and publishes their values (reverse bridge)
+type Poller interface {
+	// Poll all devices until ctx is done, values are sent to channel (pairs of topic and value), typically read by MQTT publisher,
+	// channel must not be command channel of smart meter (see @SmartMeter.SetCommandChannel), polling would fill it
+	Start(ctx context.Context, chanPublish chan [2]string)
+
+	// Set logger, see @Logger (call it before poller starts)
+	SetLogger(logger Logger)
+}
+
+// pollBlock is block of registers (bits) read by one request
+type pollBlock struct {
+	dataBlock int
+	addr      uint16
+	quantity  uint16
+	// Values in block, register numbers are absolute
+	regs     []int
+	mappings []MappingTypeTable
+}
+
+type pollDevice struct {
+	nodeID     string
+	unitID     byte
+	client     Client
+	interval   time.Duration
+	maxBackoff time.Duration
+	blocks     []pollBlock
+}
+
+type poller struct {
+	devices []pollDevice
+	topic   string
+	logger  Logger
+	// Serial lines of RTU devices are closed when polling ends
+	clients deviceClients
+}
+
+// NewPoller creates poller of devices according to "PollDevices" in config file, it does nothing if there are no devices
+func NewPoller(config string) (Poller, error) {
+
+	file, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mapp PollJSONTable
+	if err = json.NewDecoder(file).Decode(&mapp); err != nil {
+		return nil, err
+	}
+
+	p := &poller{topic: mapp.PollTopic, logger: defaultLogger}
+	if p.topic == "" {
+		p.topic = DefaultPollTopic
+	}
+	if len(mapp.PollDevices) == 0 {
+		return p, nil
+	}
+
+	cfg, err := LoadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	smTypes := buildTypes(cfg.Types)
+
+	for i, dev := range mapp.PollDevices {
+		if dev.NodeID == "" {
+			p.clients.close()
+			return nil, fmt.Errorf("modbus: PollDevices[%d]: NodeID is empty", i)
+		}
+		if dev.Type < 0 || dev.Type >= len(smTypes) {
+			p.clients.close()
+			return nil, fmt.Errorf("modbus: PollDevices[%d]: unknown Type %d", i, dev.Type)
+		}
+		if dev.UnitID < 0 || dev.UnitID > 0xFF {
+			p.clients.close()
+			return nil, fmt.Errorf("modbus: PollDevices[%d]: UnitID %d out of range", i, dev.UnitID)
+		}
+
+		device := pollDevice{nodeID: dev.NodeID, unitID: byte(dev.UnitID), interval: DefaultPollInterval, maxBackoff: DefaultMaxBackoff,
+			blocks: pollBlocks(smTypes[dev.Type])}
+		if dev.PollInterval > 0 {
+			device.interval = time.Duration(dev.PollInterval) * time.Millisecond
+		}
+		if dev.MaxBackoff > 0 {
+			device.maxBackoff = time.Duration(dev.MaxBackoff) * time.Millisecond
+		}
+
+		device.client, err = p.clients.client(dev.Address, dev.Serial, dev.BaudRate)
+		if err != nil {
+			p.clients.close()
+			return nil, fmt.Errorf("modbus: PollDevices[%d]: %v", i, err)
+		}
+
+		p.devices = append(p.devices, device)
+	}
+
+	return p, nil
+}
+
+// pollBlocks splits mapped registers (bits) of type to blocks read by one request
+func pollBlocks(smType MappingAllTypeTable) (blocks []pollBlock) {
+
+	for _, dataBlock := range []int{DataBlockHoldingRegisters, DataBlockInputRegisters, DataBlockCoils, DataBlockDiscreteInputs} {
+		maxQuantity := uint16(125)
+		if dataBlock == DataBlockCoils || dataBlock == DataBlockDiscreteInputs {
+			maxQuantity = 2000
+		}
+
+		regs := make([]int, 0, len(smType.mType[dataBlock]))
+		for reg := range smType.mType[dataBlock] {
+			regs = append(regs, reg)
+		}
+		sort.Ints(regs)
+
+		var block *pollBlock
+		for _, reg := range regs {
+			mapping := smType.mType[dataBlock][reg]
+			length := valueTypeLength(mapping.valType)
+
+			// Write only registers are not polled
+			if mapping.access == RegisterAccessWrite {
+				continue
+			}
+
+			// Value continues current block if it follows previous one and block is not too long
+			if block == nil || reg != int(block.addr)+int(block.quantity) || block.quantity+length > maxQuantity {
+				blocks = append(blocks, pollBlock{dataBlock: dataBlock, addr: uint16(reg)})
+				block = &blocks[len(blocks)-1]
+			}
+			block.quantity += length
+			block.regs = append(block.regs, reg)
+			block.mappings = append(block.mappings, mapping)
+		}
+	}
+
+	return blocks
+}
+
+func (p *poller) SetLogger(logger Logger) {
+	p.logger = logger
+}
+
+func (p *poller) Start(ctx context.Context, chanPublish chan [2]string) {
+
+	var wg sync.WaitGroup
+	for i := range p.devices {
+		wg.Add(1)
+		go func(device *pollDevice) {
+			defer wg.Done()
+			p.pollDevice(ctx, device, chanPublish)
+		}(&p.devices[i])
+	}
+	wg.Wait()
+
+	p.clients.close()
+}
+
+// pollDevice polls device until ctx is done, interval is doubled after each error up to max backoff
+func (p *poller) pollDevice(ctx context.Context, device *pollDevice, chanPublish chan [2]string) {
+
+	defer device.client.Close()
+
+	l := p.logger.With(F("node", device.nodeID), F("unit", device.unitID))
+	var backoff time.Duration
+	for {
+		wait := device.interval
+		if err := p.poll(ctx, device, chanPublish); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if backoff == 0 {
+				backoff = device.interval
+			}
+			backoff *= 2
+			if backoff > device.maxBackoff {
+				backoff = device.maxBackoff
+			}
+			wait = backoff
+			l.Warn("Polling error", F("error", err), F("retry", wait))
+		} else {
+			backoff = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// poll reads all blocks of device and publishes their values
+func (p *poller) poll(ctx context.Context, device *pollDevice, chanPublish chan [2]string) (err error) {
+
+	for _, block := range device.blocks {
+		var values []string
+
+		switch block.dataBlock {
+		case DataBlockHoldingRegisters, DataBlockInputRegisters:
+			var regs []uint16
+			if block.dataBlock == DataBlockHoldingRegisters {
+				regs, err = device.client.ReadHoldingRegisters(device.unitID, block.addr, block.quantity)
+			} else {
+				regs, err = device.client.ReadInputRegisters(device.unitID, block.addr, block.quantity)
+			}
+			if err != nil {
+				return err
+			}
+
+			data := registersBytes(regs)
+			for i, reg := range block.regs {
+				offset := (reg - int(block.addr)) * 2
+				length := int(valueTypeLength(block.mappings[i].valType)) * 2
+				valueString, errHandler := decodeRegisterValue(p.logger, block.mappings[i], data[offset:offset+length])
+				if errHandler.ExceptionCode != ExceptionCodeSuccess {
+					return errHandler
+				}
+				values = append(values, valueString)
+			}
+		case DataBlockCoils, DataBlockDiscreteInputs:
+			var bits []bool
+			if block.dataBlock == DataBlockCoils {
+				bits, err = device.client.ReadCoils(device.unitID, block.addr, block.quantity)
+			} else {
+				bits, err = device.client.ReadDiscreteInputs(device.unitID, block.addr, block.quantity)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, reg := range block.regs {
+				values = append(values, strconv.FormatBool(bits[reg-int(block.addr)]))
+			}
+		}
+
+		for i, value := range values {
+			topic := strings.NewReplacer("{nodeID}", device.nodeID, "{topic}", block.mappings[i].topic).Replace(p.topic)
+			p.logger.Debug("Publishing polled value", F("topic", topic), F("value", value))
+			select {
+			case chanPublish <- [2]string{topic, value}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// MaxRTUFrameLength - unit ID (1B) + PDU (max 253B) + CRC (2B)
+const MaxRTUFrameLength = 256
+
+// crc16 computes modbus RTU CRC (polynomial 0xA001, initial value 0xFFFF), it is sent low byte first
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// rtuSilentInterval returns 3.5 character time for baud rate (11 bits per character), fixed 1.75 ms above 19200 bauds
+func rtuSilentInterval(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(35*11) * time.Second / time.Duration(10*baudRate)
+}
+
+// rtuToADU checks CRC of RTU frame (unit ID + PDU + CRC) and converts it to ADU with MBAP header (transaction ID 0)
+func rtuToADU(frame []byte) (adu []byte, ok bool) {
+
+	// unit ID (1B) + function code (1B) + CRC (2B)
+	frameLength := len(frame)
+	if frameLength < 4 || frameLength > MaxRTUFrameLength {
+		return nil, false
+	}
+
+	if crc16(frame[:frameLength-2]) != binary.LittleEndian.Uint16(frame[frameLength-2:]) {
+		return nil, false
+	}
+
+	return pduToADU(frame[:frameLength-2]), true
+}
+
+// pduToADU prepends MBAP header (transaction ID 0) to unit ID + PDU
+func pduToADU(pdu []byte) (adu []byte) {
+
+	// MBAP length = unit ID + PDU
+	length := len(pdu)
+	adu = make([]byte, 6+length)
+	binary.BigEndian.PutUint16(adu[4:], uint16(length))
+	copy(adu[6:], pdu)
+
+	return adu
+}
+
+// aduToRTU converts ADU (MBAP + PDU) to RTU frame (unit ID + PDU + CRC)
+func aduToRTU(adu []byte) (frame []byte) {
+	frame = make([]byte, len(adu)-6+2)
+	copy(frame, adu[6:])
+	binary.LittleEndian.PutUint16(frame[len(frame)-2:], crc16(frame[:len(frame)-2]))
+	return frame
+}
+
+// rtuFramer splits serial line stream to RTU frames by silent interval, implements Framer interface
+type rtuFramer struct {
+	w io.Writer
+	// 3.5 character time, see @rtuSilentInterval
+	silentInterval time.Duration
+
+	// Received chunks of data, read by separate goroutine
+	chanData chan []byte
+	chanErr  chan error
+
+	// Max time of waiting for frame, 0 if it is not limited (used by client)
+	readTimeout time.Duration
+
+	// Dropped frames are logged by logger of server or client
+	logger Logger
+}
+
+// ErrRTUTimeout is returned by RTU framer of client if no frame comes within timeout
+var ErrRTUTimeout = errors.New("modbus: RTU frame timeout")
+
+// NewRTUFramer creates framer for modbus RTU on serial line with specified baud rate
+func NewRTUFramer(port io.ReadWriter, baudRate int) Framer {
+	return newRTUFramer(port, baudRate, defaultLogger)
+}
+
+func newRTUFramer(port io.ReadWriter, baudRate int, logger Logger) *rtuFramer {
+	f := &rtuFramer{w: port, silentInterval: rtuSilentInterval(baudRate), chanData: make(chan []byte, 16), chanErr: make(chan error, 1), logger: logger}
+	go f.receive(port)
+	return f
+}
+
+// receive reads serial line and passes received chunks of data to framer
+func (f *rtuFramer) receive(r io.Reader) {
+	for {
+		data := make([]byte, MaxRTUFrameLength)
+		n, err := r.Read(data)
+		if n > 0 {
+			f.chanData <- data[:n]
+		}
+		if err != nil {
+			f.chanErr <- err
+			return
+		}
+	}
+}
+
+/**
+* ReadADU waits for frame ended by silent interval, frames with bad CRC or length are dropped
+* @return adu []byte whole ADU (MBAP with transaction ID 0 + PDU)
+ */
+func (f *rtuFramer) ReadADU() (adu []byte, err error) {
+
+	var timeout <-chan time.Time
+	if f.readTimeout > 0 {
+		timer := time.NewTimer(f.readTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		// Wait for first chunk of frame
+		var frame []byte
+		select {
+		case data := <-f.chanData:
+			frame = data
+		case err = <-f.chanErr:
+			return nil, err
+		case <-timeout:
+			return nil, ErrRTUTimeout
+		}
+
+		// Collect chunks until line is silent
+		timer := time.NewTimer(f.silentInterval)
+		for silent := false; !silent; {
+			select {
+			case data := <-f.chanData:
+				frame = append(frame, data...)
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(f.silentInterval)
+			case <-timer.C:
+				silent = true
+			}
+		}
+
+		adu, ok := rtuToADU(frame)
+		if ok {
+			return adu, nil
+		}
+
+		f.logger.Warn("Dropping invalid RTU frame", F("frame", frame))
+	}
+}
+
+// WriteADU writes ADU as RTU frame, nothing is written for broadcast requests (unit ID 0)
+func (f *rtuFramer) WriteADU(adu []byte) (err error) {
+	if adu[6] == 0 {
+		return nil
+	}
+
+	_, err = f.w.Write(aduToRTU(adu))
+	return err
+}
+
+// rtuStreamFramer splits TCP stream with RTU frames (RTU over TCP), frame length is given by function code, implements Framer interface
+type rtuStreamFramer struct {
+	r      *bufio.Reader
+	w      io.Writer
+	logger Logger
+}
+
+// NewRTUStreamFramer creates framer for RTU frames tunneled over TCP stream
+func NewRTUStreamFramer(rw io.ReadWriter) Framer {
+	return newRTUStreamFramer(rw, defaultLogger)
+}
+
+func newRTUStreamFramer(rw io.ReadWriter, logger Logger) *rtuStreamFramer {
+	return &rtuStreamFramer{r: bufio.NewReaderSize(rw, MaxRTUFrameLength), w: rw, logger: logger}
+}
+
+/**
+* ReadADU reads RTU request according to its function code (there is no silent interval in stream), frames with bad CRC are dropped
+* @return adu []byte whole ADU (MBAP with transaction ID 0 + PDU), only unit ID and function code for ErrUnknownFunction
+ */
+func (f *rtuStreamFramer) ReadADU() (adu []byte, err error) {
+
+	for {
+		// unit ID (1B) + function code (1B) + fixed part of request data
+		frame := make([]byte, 2, MaxRTUFrameLength)
+		if _, err = io.ReadFull(f.r, frame); err != nil {
+			return nil, err
+		}
+
+		var fixed int
+		switch frame[1] {
+		case FuncCodeReadCoils, FuncCodeReadDiscreteInputs, FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters,
+			FuncCodeWriteSingleCoil, FuncCodeWriteSingleRegister:
+			// address (2B) + quantity/value (2B)
+			fixed = 4
+		case FuncCodeWriteMultipleCoils, FuncCodeWriteMultipleRegisters:
+			// address (2B) + quantity (2B) + byte count (1B)
+			fixed = 5
+		case FuncCodeReadWriteMultipleRegisters:
+			// read address (2B) + read quantity (2B) + write address (2B) + write quantity (2B) + byte count (1B)
+			fixed = 9
+		default:
+			// End of request is unknown, so buffered data are dropped (stream is synchronized again by next request of client) and request is answered by exception
+			f.r.Discard(f.r.Buffered())
+			return pduToADU(frame), ErrUnknownFunction
+		}
+
+		frame = frame[:2+fixed]
+		if _, err = io.ReadFull(f.r, frame[2:]); err != nil {
+			return nil, err
+		}
+
+		// Variable part (values) is given by byte count (last byte of fixed part), CRC (2B) follows
+		rest := 2
+		if fixed > 4 {
+			rest += int(frame[len(frame)-1])
+		}
+		frame = frame[:len(frame)+rest]
+		if _, err = io.ReadFull(f.r, frame[len(frame)-rest:]); err != nil {
+			return nil, err
+		}
+
+		adu, ok := rtuToADU(frame)
+		if ok {
+			return adu, nil
+		}
+
+		f.logger.Warn("Dropping RTU frame with bad CRC", F("frame", frame))
+	}
+}
+
+// WriteADU writes ADU as RTU frame, nothing is written for broadcast requests (unit ID 0)
+func (f *rtuStreamFramer) WriteADU(adu []byte) (err error) {
+	if adu[6] == 0 {
+		return nil
+	}
+
+	_, err = f.w.Write(aduToRTU(adu))
+	return err
+}
+
+// rtuServer is modbus RTU slave on serial line, it shares request handling with TCP server
+type rtuServer struct {
+	server
+	port     io.ReadWriter
+	baudRate int
+}
+
+// ServerStart serves requests from serial line until it is closed, Shutdown closes serial line if it implements io.Closer
+func (s *rtuServer) ServerStart() (err error) {
+
+	if closer, ok := s.port.(io.Closer); ok {
+		if !s.addListener(closer) {
+			return ErrServerClosed
+		}
+		defer s.removeListener(closer)
+	}
+	if err = s.addHandler(nil); err != nil {
+		return err
+	}
+	defer s.removeHandler(nil)
+
+	framer := newRTUFramer(s.port, s.baudRate, s.logger)
+	for {
+		if err = s.Read(nil, framer); err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			s.logger.Error("RTU server stopped", F("error", err))
+			return err
+		}
+		if s.isClosed() {
+			return ErrServerClosed
+		}
+	}
+}
+
+// NewRTUServer creates modbus RTU slave on serial line port (any io.ReadWriter, ie. opened tty), baud rate is used for silent interval detection,
+// frames for unit IDs which are neither mapped nor routed by gateway are not answered (they belong to other slaves on the line)
+func NewRTUServer(port io.ReadWriter, baudRate int, sm SmartMeter) Server {
+	return &rtuServer{server: server{sm: sm, logger: defaultLogger, dropForeignUnits: true}, port: port, baudRate: baudRate}
+}
@@ -0,0 +1,280 @@
+package modbus
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data []byte
+		crc  uint16
+	}{
+		{[]byte{}, 0xFFFF},
+		{[]byte("123456789"), 0x4B37},
+		// Frames from modbus over serial line specification (CRC is sent low byte first)
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}, 0xCDC5},
+		{[]byte{0x11, 0x03, 0x00, 0x6B, 0x00, 0x03}, 0x8776},
+	}
+
+	for _, test := range tests {
+		if crc := crc16(test.data); crc != test.crc {
+			t.Errorf("crc16(% X) = %04X, want %04X", test.data, crc, test.crc)
+		}
+	}
+
+	if frame := aduToRTU(mbap(0, 1, FuncCodeReadHoldingRegisters, 0, 0, 0, 0x0A)); !bytes.Equal(frame, []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A, 0xC5, 0xCD}) {
+		t.Errorf("RTU frame % X", frame)
+	}
+}
+
+// serialLine connects test with framer or server by pipes (reads of both ends block until other end writes)
+type serialLine struct {
+	// Port of framer or server
+	port struct {
+		io.Reader
+		io.Writer
+	}
+	// Ends of test
+	request  *io.PipeWriter
+	response *io.PipeReader
+}
+
+func newSerialLine(t *testing.T) *serialLine {
+	line := &serialLine{}
+	var requestReader *io.PipeReader
+	var responseWriter *io.PipeWriter
+	requestReader, line.request = io.Pipe()
+	line.response, responseWriter = io.Pipe()
+	line.port.Reader, line.port.Writer = requestReader, responseWriter
+	t.Cleanup(func() {
+		line.request.Close()
+		line.response.Close()
+	})
+	return line
+}
+
+// send writes chunks to serial line, pause is inserted between chunks
+func (line *serialLine) send(pause time.Duration, chunks ...[]byte) {
+	for i, chunk := range chunks {
+		if i > 0 && pause > 0 {
+			time.Sleep(pause)
+		}
+		line.request.Write(chunk)
+	}
+}
+
+func TestRTUFramerReadADU(t *testing.T) {
+	frame := aduToRTU(mbap(0, 1, FuncCodeReadHoldingRegisters, 0, 100, 0, 2))
+	other := aduToRTU(mbap(0, 2, FuncCodeReadCoils, 0, 0, 0, 8))
+	badCRC := append([]byte{}, frame...)
+	badCRC[len(badCRC)-1] ^= 0xFF
+
+	// Silent interval at 9600 bauds is 4 ms
+	const baudRate = 9600
+	gap := 10 * rtuSilentInterval(baudRate)
+
+	tests := []struct {
+		name   string
+		pause  time.Duration
+		chunks [][]byte
+		want   [][]byte
+	}{
+		{"one chunk", 0, [][]byte{frame}, [][]byte{frame}},
+		{"chunks within silent interval", 0, [][]byte{frame[:1], frame[1:3], frame[3:]}, [][]byte{frame}},
+		{"frames separated by silent interval", gap, [][]byte{frame, other}, [][]byte{frame, other}},
+		{"bad CRC dropped", gap, [][]byte{badCRC, other}, [][]byte{other}},
+		{"short frame dropped", gap, [][]byte{frame[:3], other}, [][]byte{other}},
+		{"frame split by silent interval dropped", gap, [][]byte{frame[:4], frame[4:], other}, [][]byte{other}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := newSerialLine(t)
+			framer := NewRTUFramer(line.port, baudRate)
+			go line.send(test.pause, test.chunks...)
+
+			for _, want := range test.want {
+				adu, err := framer.ReadADU()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame := aduToRTU(adu); !bytes.Equal(frame, want) {
+					t.Fatalf("frame % X, want % X", frame, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRTUFramerWriteADU(t *testing.T) {
+	line := newSerialLine(t)
+	framer := NewRTUFramer(line.port, 9600)
+
+	go func() {
+		// Broadcast (unit ID 0) is not answered
+		framer.WriteADU(mbap(0, 0, FuncCodeWriteSingleCoil, 0, 0, 0xFF, 0))
+		framer.WriteADU(mbap(0, 1, FuncCodeWriteSingleCoil, 0, 0, 0xFF, 0))
+	}()
+
+	response := make([]byte, MaxRTUFrameLength)
+	n, err := line.response.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := aduToRTU(mbap(0, 1, FuncCodeWriteSingleCoil, 0, 0, 0xFF, 0)); !bytes.Equal(response[:n], want) {
+		t.Errorf("frame % X, want % X", response[:n], want)
+	}
+}
+
+func TestRTUServer(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/relay", "1")
+	sm.WriteValues("Node1/alarm", "1")
+	sm.WriteValues("Node1/count", "513")
+
+	line := newSerialLine(t)
+	s := NewRTUServer(line.port, 9600, sm)
+	go s.ServerStart()
+
+	readCoils := []byte{1, FuncCodeReadCoils, 0, 0, 0, 2}
+	tests := []struct {
+		name     string
+		foreign  [][]byte
+		request  []byte
+		response []byte
+	}{
+		{"read coils", nil, readCoils, []byte{1, FuncCodeReadCoils, 1, 3}},
+		{"read holding registers", nil, []byte{1, FuncCodeReadHoldingRegisters, 0, 104, 0, 1}, []byte{1, FuncCodeReadHoldingRegisters, 2, 2, 1}},
+		{"exception", nil, []byte{1, FuncCodeReadHoldingRegisters, 0, 50, 0, 1}, []byte{1, FuncCodeReadHoldingRegisters | 0x80, ExceptionCodeIllegalDataAddress}},
+		// Frames of other slaves are not answered, only response to following request is received
+		{"request for other unit", [][]byte{{7, FuncCodeReadCoils, 0, 0, 0, 1}}, readCoils, []byte{1, FuncCodeReadCoils, 1, 3}},
+		{"response of other unit", [][]byte{{5, FuncCodeReadHoldingRegisters, 4, 0, 1, 0, 2}}, readCoils, []byte{1, FuncCodeReadCoils, 1, 3}},
+		{"exception of other unit", [][]byte{{5, FuncCodeReadHoldingRegisters | 0x80, ExceptionCodeIllegalDataAddress}}, readCoils, []byte{1, FuncCodeReadCoils, 1, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var frames [][]byte
+			for _, foreign := range test.foreign {
+				frames = append(frames, aduToRTU(pduToADU(foreign)))
+			}
+			frame := aduToRTU(pduToADU(test.request))
+
+			go func() {
+				line.send(10*rtuSilentInterval(9600), frames...)
+				if len(frames) > 0 {
+					time.Sleep(10 * rtuSilentInterval(9600))
+				}
+				// Request is split to chunks within silent interval
+				line.send(0, frame[:3], frame[3:])
+			}()
+
+			response := make([]byte, MaxRTUFrameLength)
+			n, err := line.response.Read(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := aduToRTU(pduToADU(test.response)); !bytes.Equal(response[:n], want) {
+				t.Errorf("response % X, want % X", response[:n], want)
+			}
+		})
+	}
+}
+
+func TestRTUOverTCPServer(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/count", "513")
+	_, port := startTestServer(t, sm, func(s Server) {
+		s.SetFraming(FramingRTUOverTCP)
+	})
+	c := dialTestServer(t, port)
+
+	readCount := aduToRTU(pduToADU([]byte{1, FuncCodeReadHoldingRegisters, 0, 104, 0, 1}))
+	countResponse := aduToRTU(pduToADU([]byte{1, FuncCodeReadHoldingRegisters, 2, 2, 1}))
+
+	tests := []struct {
+		name     string
+		request  []byte
+		response []byte
+	}{
+		{"read holding registers", readCount, countResponse},
+		// Length of diagnostics and device identification requests is unknown, connection is kept
+		{"diagnostics", aduToRTU(pduToADU([]byte{1, 8, 0, 0, 0x12, 0x34})), aduToRTU(pduToADU([]byte{1, 8 | 0x80, ExceptionCodeIllegalFunction}))},
+		{"read device identification", aduToRTU(pduToADU([]byte{1, 43, 14, 1, 0})), aduToRTU(pduToADU([]byte{1, 43 | 0x80, ExceptionCodeIllegalFunction}))},
+		{"read after unknown function", readCount, countResponse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := exchange(t, c, test.request); !bytes.Equal(response, test.response) {
+				t.Errorf("response % X, want % X", response, test.response)
+			}
+		})
+	}
+}
+
+// lockedBuffer is log output shared by server goroutines and test
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFramerLogger(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/count", "513")
+
+	var defaultLog, serverLog lockedBuffer
+	SetDefaultLogger(NewLogger(&defaultLog, LevelDebug))
+	defer SetDefaultLogger(NewLogger(io.Discard, LevelError))
+	request := aduToRTU(pduToADU([]byte{1, FuncCodeReadHoldingRegisters, 0, 104, 0, 1}))
+	badCRC := append([]byte{}, request...)
+	badCRC[len(badCRC)-1]++
+
+	tests := []struct {
+		name     string
+		framing  int
+		request  []byte
+		response []byte
+		warning  string
+	}{
+		{"RTU over TCP", FramingRTUOverTCP, append(badCRC, request...), aduToRTU(pduToADU([]byte{1, FuncCodeReadHoldingRegisters, 2, 2, 1})), "Dropping RTU frame with bad CRC"},
+		{"ASCII", FramingASCII, []byte("garbage\r\n:01030068000193\r\n"), []byte(":0103020201F7\r\n"), "Dropping ASCII line without start of frame"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, port := startTestServer(t, sm, func(s Server) {
+				s.SetFraming(test.framing)
+				s.SetLogger(NewLogger(&serverLog, LevelWarn))
+			})
+			c := dialTestServer(t, port)
+
+			if response := exchange(t, c, test.request); !bytes.Equal(response, test.response) {
+				t.Errorf("response %q, want %q", response, test.response)
+			}
+			if log := serverLog.String(); !strings.Contains(log, test.warning) || !strings.Contains(log, "remote=") {
+				t.Errorf("warning is not logged by server logger: %q", log)
+			}
+		})
+	}
+	if log := defaultLog.String(); log != "" {
+		t.Errorf("default logger used: %q", log)
+	}
+}
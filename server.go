@@ -1,18 +1,47 @@
 package modbus
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
+// ErrServerClosed is returned by ServerStart functions after Shutdown
+var ErrServerClosed = errors.New("modbus: server closed")
+
 type server struct {
 	port int
 	addr string
 	sm   SmartMeter
+	// Framing of connections, see @FramingMode consts
+	framing int
+	// Permissions of roles of TLS clients, see @TLSConfig
+	roles map[string]RolePermissions
+	// Limits of connections, see @Limits
+	limits Limits
+	// Access control of clients, nil allows all requests
+	access AccessControl
+	// Logger of server, see @Logger
+	logger Logger
+	// Metrics of requests and connections, nil disables them
+	metrics Metrics
+	// Gateway to downstream devices, nil disables forwarding
+	gateway Gateway
+	// Frames for unit IDs neither mapped nor routed by gateway are dropped without response (multi-drop serial line)
+	dropForeignUnits bool
+
+	// Listeners, connections and running handlers for Shutdown
+	mu        sync.Mutex
+	closed    bool
+	listeners map[io.Closer]struct{}
+	conns     map[net.Conn]struct{}
+	hostConns map[string]int
+	handlers  sync.WaitGroup
 }
 
 func (s *server) ServerStart() (err error) {
@@ -23,27 +52,31 @@ func (s *server) ServerStart() (err error) {
 
 	// Check if it was succesufully created
 	if err != nil {
-		log.Println("Not possible to create server: ", err.Error())
+		s.logger.Error("Not possible to create server", F("error", err))
 		return err
 	}
+	if !s.addListener(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(ln)
 
 	// Run it
 	for {
-		if LoggerEnable {
-			log.Println("Waiting for new request")
-		}
+		s.logger.Debug("Waiting for new request")
 
 		// Wait for request
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			// Handle error
-			log.Println("Accept error: ", err.Error())
+			s.logger.Warn("Accept error", F("error", err))
 			continue
 		}
 
-		if LoggerEnable {
-			log.Println("Handle request")
-		}
+		s.logger.Debug("Handle request")
 		// Asynchronously handle request
 		go s.HandleClient(conn)
 	}
@@ -55,102 +88,269 @@ func (s *server) HandleClient(c net.Conn) {
 
 	defer c.Close()
 
+	if err := s.addHandler(c); err != nil {
+		if err == errConnLimit {
+			s.rejectClient(c)
+		}
+		return
+	}
+	defer s.removeHandler(c)
+
+	// Framer keeps data of following requests received together with current one, deadlines are set by connection wrapper
+	tc := &timeoutConn{Conn: c, s: s}
+	framer := s.newFramer(tc)
 	for {
-		if s.Read(c) != nil {
+		tc.nextRequest()
+		if s.Read(c, framer) != nil || s.isClosed() {
 			break
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func (s *server) Read(c net.Conn) (err error) {
+// Shutdown closes listeners, wakes up connections waiting for next request and waits until handlers finish
+func (s *server) Shutdown(ctx context.Context) (err error) {
 
-	// Buffer to store received data
-	data := make([]byte, MaxADULength)
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	// Request in progress is finished (its response is written), waiting for next one is interrupted
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Close remaining connections forcibly
+		s.mu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
 
-	if LoggerEnable {
-		log.Println("Reading available data...")
+// isClosed checks if Shutdown was called
+func (s *server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// addListener registers listener (or serial line) closed by Shutdown, false is returned if server is already closed
+func (s *server) addListener(ln io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
 	}
+	if s.listeners == nil {
+		s.listeners = make(map[io.Closer]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
 
-	// Read available data
-	n, err := c.Read(data)
+func (s *server) removeListener(ln io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, ln)
+}
 
-	// Check for errors
-	if err != nil {
-		log.Println("Read error:", err.Error())
-		if err != io.EOF {
-			if n == MaxADULength {
-				log.Println("Read error (packet length is bigger than max ADU length):", err.Error())
-			} else {
-				log.Println("Read error:", err.Error())
-			}
-			return err
+// addHandler registers running handler (and its connection if c is not nil) waited for by Shutdown, connection is checked against limits
+func (s *server) addHandler(c net.Conn) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if c != nil {
+		host := hostOf(c)
+		if !s.checkLimits(host) {
+			return errConnLimit
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+			s.hostConns = make(map[string]int)
+		}
+		s.conns[c] = struct{}{}
+		s.hostConns[host]++
+		if s.metrics != nil {
+			s.metrics.ConnOpened()
+		}
+	}
+	s.handlers.Add(1)
+	return nil
+}
+
+func (s *server) removeHandler(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c != nil {
+		delete(s.conns, c)
+		host := hostOf(c)
+		if s.hostConns[host]--; s.hostConns[host] == 0 {
+			delete(s.hostConns, host)
+		}
+		if s.metrics != nil {
+			s.metrics.ConnClosed()
 		}
 	}
+	s.handlers.Done()
+}
+
+// SetLogger sets logger of server
+func (s *server) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// SetFraming sets framing mode of connections
+func (s *server) SetFraming(mode int) {
+	s.framing = mode
+}
 
-	if LoggerEnable {
-		log.Println("Data length: ", n)
-		log.Println("Data: ", data[:n])
+// newFramer creates framer for connection according to framing mode, dropped frames are logged by server logger with client address
+func (s *server) newFramer(c net.Conn) Framer {
+	switch s.framing {
+	case FramingRTUOverTCP:
+		return newRTUStreamFramer(c, s.logger.With(F("remote", c.RemoteAddr())))
+	case FramingASCII:
+		return newASCIIFramer(c, s.logger.With(F("remote", c.RemoteAddr())))
+	default:
+		return NewMBAPFramer(c)
 	}
+}
 
-	if LoggerEnable {
-		log.Println("Parsing request...")
+func (s *server) Read(c net.Conn, f Framer) (err error) {
+
+	// Messages about this request include client address, then MBAP and function code
+	l := s.logger
+	if c != nil {
+		l = l.With(F("remote", c.RemoteAddr()))
+	}
+	l.Debug("Reading next request")
+
+	// Read whole ADU
+	data, err := f.ReadADU()
+
+	// Request with unknown function code is answered, the framer has dropped rest of it already
+	if err == ErrUnknownFunction {
+		request := ADUUnit{unitID: data[6], functionCode: data[7]}
+		errHandler := ErrorHandler{FunctionCode: request.functionCode, ExceptionCode: ExceptionCodeIllegalFunction}
+		s.fault(l.With(F("unit", request.unitID), F("fc", request.functionCode)), &errHandler, "Unknown function code, rest of request is dropped")
+		s.observe(&request, errHandler, time.Now())
+		return s.Write(f, s.ResponseException(&request, errHandler))
 	}
 
+	// Check for other errors, connection is closed on any of them (stream can not be synchronized again)
+	if err != nil {
+		if err == ErrFrameLength {
+			l.Warn("Read error (frame length is out of range)", F("error", err))
+		} else if err != io.EOF {
+			l.Warn("Read error", F("error", err))
+		}
+		return err
+	}
+
+	l.Debug("Received data", F("length", len(data)), F("data", data))
+
+	// Other slaves on the line answer requests for their unit IDs (responses of them are received too)
+	if s.dropForeignUnits && !s.servesUnit(data[6]) {
+		l.Debug("Dropping frame for other unit", F("unit", data[6]))
+		return nil
+	}
+
+	start := time.Now()
+
+	l.Debug("Parsing request...")
+
 	// Get request (parse it)
 	request := ADUUnit{}
-	errHandler := s.ParseRequest(data[:n], &request)
+	errHandler := s.ParseRequest(data, &request)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
-		//TODO check error
-		log.Println("Parse error:", errHandler)
-		//TODO write and send error to client?
-		// TMP
-		return
-	}
+		s.fault(l.With(F("fc", errHandler.FunctionCode)), &errHandler, "Parse error")
 
-	if LoggerEnable {
-		log.Println("Parsed request: ", request)
+		// Without function code the MBAP header was not complete, so there is nobody to answer
+		if errHandler.FunctionCode == 0 {
+			return
+		}
+		s.observe(&request, errHandler, start)
+		return s.Write(f, s.ResponseException(&request, errHandler))
 	}
 
-	// Create response
-	response, errHandler := s.CreateResponse(&request)
+	l = l.With(F("tid", request.transactionID), F("unit", request.unitID), F("fc", request.functionCode))
+	l.Debug("Parsed request", F("data", request.data))
+
+	// Check if client is allowed to send this request
+	errHandler = s.authorize(c, &request)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
-		//TODO check error
-		log.Println("Create error: ", errHandler)
-		//TODO send error?
-		return
+		s.fault(l, &errHandler, "Authorization error")
+		s.observe(&request, errHandler, start)
+		return s.Write(f, s.ResponseException(&request, errHandler))
+	}
+	if s.access != nil && c != nil {
+		errHandler = s.access.CheckAccess(c.RemoteAddr(), &request)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			s.fault(l, &errHandler, "Access denied")
+			s.observe(&request, errHandler, start)
+			return s.Write(f, s.ResponseException(&request, errHandler))
+		}
 	}
 
-	if LoggerEnable {
-		log.Println("Created response: ", response)
-		log.Println("Sending response...")
+	// Create response, requests for unit IDs routed by gateway are forwarded to downstream devices
+	var response []byte
+	if s.gateway != nil && s.gateway.HasRoute(request.unitID) {
+		response, errHandler = s.gateway.Forward(&request)
+	} else {
+		response, errHandler = s.CreateResponse(&request)
 	}
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.fault(l, &errHandler, "Create error")
+		s.observe(&request, errHandler, start)
+		return s.Write(f, s.ResponseException(&request, errHandler))
+	}
+
+	l.Debug("Created response", F("response", response))
+	l.Debug("Sending response...")
 
-	err = s.Write(c, response)
+	s.observe(&request, errHandler, start)
+	err = s.Write(f, response)
 	if err != nil {
 		//TODO check error
-		log.Println("Write error:", err.Error())
+		l.Warn("Write error", F("error", err))
 	}
 
 	return
 }
 
+// servesUnit checks if unit ID is mapped to smart meter or routed by gateway
+func (s *server) servesUnit(unitID byte) bool {
+	return s.sm.HasUnitID(int(unitID)) || (s.gateway != nil && s.gateway.HasRoute(unitID))
+}
+
 // Write
-func (s *server) Write(c net.Conn, data []byte) (err error) {
+func (s *server) Write(f Framer, data []byte) (err error) {
 
-	//TODO
-	n, err := c.Write(data)
+	err = f.WriteADU(data)
 
 	// Check error
 	if err != nil {
-		log.Println("Sending error: ", err.Error())
-		log.Println("Number of sent bytes: ", n)
+		s.logger.Warn("Sending error", F("error", err))
 		return err
 	}
 
-	if LoggerEnable {
-		log.Println("Number of sent bytes: ", n)
-	}
+	s.logger.Debug("Sent response", F("length", len(data)))
 
 	return err
 }
@@ -163,7 +363,7 @@ func (s *server) ParseRequest(adu []byte, aduUnit *ADUUnit) (errHandler ErrorHan
 
 	// Minimal length = MBAP + functioncode, ie. 8 bytes
 	if aduLength < 8 {
-		log.Println("ADU is too short")
+		s.logger.Warn("ADU is too short")
 		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
 		return errHandler
 	}
@@ -178,7 +378,7 @@ func (s *server) ParseRequest(adu []byte, aduUnit *ADUUnit) (errHandler ErrorHan
 
 	// Check if function code is in supported modbus range (later, we check, if we support this function)
 	if aduUnit.functionCode < 1 || aduUnit.functionCode > 43 {
-		log.Println("Function code is out of range: ", aduUnit.functionCode)
+		s.logger.Warn("Function code is out of range", F("fc", aduUnit.functionCode))
 		errHandler.FunctionCode = aduUnit.functionCode
 		errHandler.ExceptionCode = ExceptionCodeIllegalFunction
 		return errHandler
@@ -191,16 +391,13 @@ func (s *server) ParseRequest(adu []byte, aduUnit *ADUUnit) (errHandler ErrorHan
 	length := binary.BigEndian.Uint16(adu[4:])
 	// This should apply: MBAP + functioncode + data == len(adu) == defined length + MBAP - 1 (unitID is included in defined length) == defined length + 6
 	if (6 + length) != uint16(len(adu)) {
-		log.Println("ADU has invalid specification of length")
+		s.logger.Warn("ADU has invalid specification of length")
 		errHandler.FunctionCode = aduUnit.functionCode
 		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
 		return errHandler
 	}
 
-	if LoggerEnable {
-		log.Println("ADU Array: ", adu)
-		log.Println("ADU Unit:  ", aduUnit)
-	}
+	s.logger.Debug("Parsed ADU", F("adu", adu))
 
 	return errHandler
 }
@@ -208,34 +405,92 @@ func (s *server) ParseRequest(adu []byte, aduUnit *ADUUnit) (errHandler ErrorHan
 func (s *server) CreateResponse(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
 
 	switch aduUnit.functionCode {
-	case FuncCodeReadHoldingRegisters:
+	case FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters:
+		// Data for RHRegs/RIRegs = address (2B) + regNum (2B)
+		if len(aduUnit.data) != 4 {
+			s.logger.Warn("Bad data length for registers function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
+
 		// Get number of registers to read
 		aduUnit.length = binary.BigEndian.Uint16(aduUnit.data[2:])
 
 		// Check if requested registers length is in defined range
 		if aduUnit.length < 1 || aduUnit.length > 125 {
-			log.Println("ADU is too short")
+			s.logger.Warn("ADU is too short")
 			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			errHandler.FunctionCode = aduUnit.functionCode
 			return nil, errHandler
 		}
-		response, errHandler = s.ResponseRHRegisters(aduUnit)
+
+		if aduUnit.functionCode == FuncCodeReadHoldingRegisters {
+			response, errHandler = s.ResponseRHRegisters(aduUnit)
+		} else {
+			response, errHandler = s.ResponseRIRegisters(aduUnit)
+		}
 
 		if errHandler.ExceptionCode != ExceptionCodeSuccess {
-			errHandler.FunctionCode = FuncCodeReadHoldingRegisters
+			errHandler.FunctionCode = aduUnit.functionCode
 			return nil, errHandler
 		}
 
 		if response == nil {
-			log.Println("No response created")
+			s.logger.Warn("No response created")
 			errHandler.ExceptionCode = ExceptionCodeCreationError
-			errHandler.FunctionCode = FuncCodeReadHoldingRegisters
+			errHandler.FunctionCode = aduUnit.functionCode
 			return nil, errHandler
 		}
 		//TODO check ErrorHandler
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs:
+		// Data for coils/discrete inputs = address (2B) + quantity (2B)
+		if len(aduUnit.data) != 4 {
+			s.logger.Warn("Bad data length for bits function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
+
+		// Get number of bits to read
+		aduUnit.length = binary.BigEndian.Uint16(aduUnit.data[2:])
+
+		// Check if requested bits quantity is in defined range
+		if aduUnit.length < 1 || aduUnit.length > 2000 {
+			s.logger.Warn("Invalid bits quantity")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
+
+		if aduUnit.functionCode == FuncCodeReadCoils {
+			response, errHandler = s.ResponseCoils(aduUnit)
+		} else {
+			response, errHandler = s.ResponseDInputs(aduUnit)
+		}
+
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
+	case FuncCodeWriteSingleCoil, FuncCodeWriteMultipleCoils:
+		response, errHandler = s.ResponseWriteCoils(aduUnit)
+
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
+	case FuncCodeWriteSingleRegister, FuncCodeWriteMultipleRegisters:
+		response, errHandler = s.ResponseWriteRegisters(aduUnit)
+
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			errHandler.FunctionCode = aduUnit.functionCode
+			return nil, errHandler
+		}
 	default:
-		log.Println("Unsupported function")
+		s.logger.Warn("Unsupported function")
 		errHandler.ExceptionCode = ExceptionCodeIllegalFunction
-		errHandler.FunctionCode = FuncCodeReadHoldingRegisters
+		errHandler.FunctionCode = aduUnit.functionCode
 		return nil, errHandler
 	}
 
@@ -244,21 +499,37 @@ func (s *server) CreateResponse(aduUnit *ADUUnit) (response []byte, errHandler E
 
 func (s *server) ResponseRHRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
 
-	if LoggerEnable {
-		log.Println("Responsing RHRegisters request...")
-	}
+	s.logger.Debug("Responsing RHRegisters request...")
 
 	value, errHandler := s.sm.GetRHRegisterValue(aduUnit.data, int(aduUnit.unitID))
 
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
-		log.Println("Unable to create reponse")
+		s.logger.Warn("Unable to create reponse")
 		return nil, errHandler
 	}
 
-	if LoggerEnable {
-		log.Println("Value buffer: ", value)
+	return s.responseRegisters(aduUnit, value), errHandler
+}
+
+func (s *server) ResponseRIRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	s.logger.Debug("Responsing RIRegisters request...")
+
+	value, errHandler := s.sm.GetRIRegisterValue(aduUnit.data, int(aduUnit.unitID))
+
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.logger.Warn("Unable to create reponse")
+		return nil, errHandler
 	}
 
+	return s.responseRegisters(aduUnit, value), errHandler
+}
+
+// responseRegisters builds registers response (common for RHRegs and RIRegs) from value buffer
+func (s *server) responseRegisters(aduUnit *ADUUnit, value []byte) (response []byte) {
+
+	s.logger.Debug("Value buffer", F("value", value))
+
 	// Number of bytes for register values (x2 because it is 16bit registers)
 	numOfRegs := aduUnit.length * 2
 	// Data length = registers values + function code (1B) + registers values length (1B) + unit ID (1B)
@@ -266,9 +537,7 @@ func (s *server) ResponseRHRegisters(aduUnit *ADUUnit) (response []byte, errHand
 	// MBAP - unit ID + data length == 7 - 1 + data length
 	finalSize := 6 + dataLength
 
-	if LoggerEnable {
-		log.Println("Final size: ", finalSize)
-	}
+	s.logger.Debug("Final size", F("size", finalSize))
 
 	// Create response buffer
 	response = make([]byte, finalSize)
@@ -285,31 +554,227 @@ func (s *server) ResponseRHRegisters(aduUnit *ADUUnit) (response []byte, errHand
 	response[4] = byte(dataLength >> 8)
 	response[5] = byte(dataLength)
 	response[6] = aduUnit.unitID
-	response[7] = FuncCodeReadHoldingRegisters
+	response[7] = aduUnit.functionCode
 	response[8] = byte(numOfRegs)
 
-	// TODO fill right data (now 0s)
-	i := 0
-	for index := uint16(9); index < finalSize; index++ {
-		response[index] = value[i]
-		i++
-		if i == 4 {
-			break
+	// Values of all requested registers
+	copy(response[9:], value)
+
+	s.logger.Debug("Registers response", F("response", response))
+
+	return response
+}
+
+func (s *server) ResponseCoils(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	s.logger.Debug("Responsing coils request...")
+
+	value, errHandler := s.sm.GetCoilsValue(aduUnit.data, int(aduUnit.unitID))
+
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.logger.Warn("Unable to create reponse")
+		return nil, errHandler
+	}
+
+	return s.responseBits(aduUnit, value), errHandler
+}
+
+func (s *server) ResponseDInputs(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	s.logger.Debug("Responsing discrete inputs request...")
+
+	value, errHandler := s.sm.GetDInputsValue(aduUnit.data, int(aduUnit.unitID))
+
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.logger.Warn("Unable to create reponse")
+		return nil, errHandler
+	}
+
+	return s.responseBits(aduUnit, value), errHandler
+}
+
+// responseBits builds bits response (common for coils and discrete inputs) from packed values
+func (s *server) responseBits(aduUnit *ADUUnit, value []byte) (response []byte) {
+
+	// Number of bytes for packed bits
+	byteCount := (aduUnit.length + 7) / 8
+	// Data length = packed bits + function code (1B) + byte count (1B) + unit ID (1B)
+	dataLength := byteCount + 3
+
+	response = make([]byte, 6+dataLength)
+	response[0] = byte(aduUnit.transactionID >> 8)
+	response[1] = byte(aduUnit.transactionID)
+	response[2] = byte(aduUnit.protocolID >> 8)
+	response[3] = byte(aduUnit.protocolID)
+	response[4] = byte(dataLength >> 8)
+	response[5] = byte(dataLength)
+	response[6] = aduUnit.unitID
+	response[7] = aduUnit.functionCode
+	response[8] = byte(byteCount)
+	copy(response[9:], value)
+
+	s.logger.Debug("Bits response", F("response", response))
+
+	return response
+}
+
+func (s *server) ResponseWriteCoils(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	s.logger.Debug("Responsing write coils request...")
+
+	var values []bool
+	if aduUnit.functionCode == FuncCodeWriteSingleCoil {
+		// Data = address (2B) + value (2B), value is 0xFF00 (on) or 0x0000 (off)
+		if len(aduUnit.data) != 4 {
+			s.logger.Warn("Bad data length for write single coil function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+
+		switch binary.BigEndian.Uint16(aduUnit.data[2:]) {
+		case 0xFF00:
+			values = []bool{true}
+		case 0x0000:
+			values = []bool{false}
+		default:
+			s.logger.Warn("Invalid coil value")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+	} else {
+		// Data = address (2B) + quantity (2B) + byte count (1B) + packed values
+		if len(aduUnit.data) < 6 {
+			s.logger.Warn("Bad data length for write multiple coils function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+
+		quantity := binary.BigEndian.Uint16(aduUnit.data[2:])
+		byteCount := int(aduUnit.data[4])
+		if quantity < 1 || quantity > 1968 || byteCount != int(quantity+7)/8 || len(aduUnit.data) != 5+byteCount {
+			s.logger.Warn("Invalid coils quantity or byte count")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+
+		values = make([]bool, quantity)
+		for i := range values {
+			values[i] = aduUnit.data[5+i/8]&(1<<uint(i%8)) != 0
 		}
 	}
 
-	if LoggerEnable {
-		log.Println("RHRegisters response: ", response)
+	bitAddr := binary.BigEndian.Uint16(aduUnit.data)
+	errHandler = s.sm.WriteCoilsValue(int(aduUnit.unitID), bitAddr, values)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.logger.Warn("Unable to write coils")
+		return nil, errHandler
 	}
 
-	return response, errHandler
+	// Response is echo of address and value (single) or address and quantity (multiple)
+	return s.responseData(aduUnit, aduUnit.data[:4]), errHandler
+}
+
+func (s *server) ResponseWriteRegisters(aduUnit *ADUUnit) (response []byte, errHandler ErrorHandler) {
+
+	s.logger.Debug("Responsing write registers request...")
+
+	var regs []byte
+	if aduUnit.functionCode == FuncCodeWriteSingleRegister {
+		// Data = address (2B) + value (2B)
+		if len(aduUnit.data) != 4 {
+			s.logger.Warn("Bad data length for write single register function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+		regs = aduUnit.data[2:4]
+	} else {
+		// Data = address (2B) + quantity (2B) + byte count (1B) + values
+		if len(aduUnit.data) < 7 {
+			s.logger.Warn("Bad data length for write multiple registers function")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+
+		quantity := binary.BigEndian.Uint16(aduUnit.data[2:])
+		byteCount := int(aduUnit.data[4])
+		if quantity < 1 || quantity > 123 || byteCount != int(quantity)*2 || len(aduUnit.data) != 5+byteCount {
+			s.logger.Warn("Invalid registers quantity or byte count")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return nil, errHandler
+		}
+		regs = aduUnit.data[5:]
+	}
+
+	regAddr := binary.BigEndian.Uint16(aduUnit.data)
+	errHandler = s.sm.WriteRHRegistersValue(int(aduUnit.unitID), regAddr, regs)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		s.logger.Warn("Unable to write registers")
+		return nil, errHandler
+	}
+
+	// Response is echo of address and value (single) or address and quantity (multiple)
+	return s.responseData(aduUnit, aduUnit.data[:4]), errHandler
+}
+
+// responseData builds response with function code of the request followed by data
+func (s *server) responseData(aduUnit *ADUUnit, data []byte) (response []byte) {
+
+	// Data length = data + function code (1B) + unit ID (1B)
+	dataLength := uint16(len(data)) + 2
+
+	response = make([]byte, 6+dataLength)
+	response[0] = byte(aduUnit.transactionID >> 8)
+	response[1] = byte(aduUnit.transactionID)
+	response[2] = byte(aduUnit.protocolID >> 8)
+	response[3] = byte(aduUnit.protocolID)
+	response[4] = byte(dataLength >> 8)
+	response[5] = byte(dataLength)
+	response[6] = aduUnit.unitID
+	response[7] = aduUnit.functionCode
+	copy(response[8:], data)
+
+	s.logger.Debug("Response", F("response", response))
+
+	return response
+}
+
+// ResponseException creates exception response (function code | 0x80 + exception code) for the request
+func (s *server) ResponseException(aduUnit *ADUUnit, errHandler ErrorHandler) (response []byte) {
+
+	functionCode := errHandler.FunctionCode
+	if functionCode == 0 {
+		functionCode = aduUnit.functionCode
+	}
+
+	// Data length = unit ID (1B) + function code (1B) + exception code (1B)
+	dataLength := uint16(3)
+
+	response = make([]byte, 6+dataLength)
+	response[0] = byte(aduUnit.transactionID >> 8)
+	response[1] = byte(aduUnit.transactionID)
+	response[2] = byte(aduUnit.protocolID >> 8)
+	response[3] = byte(aduUnit.protocolID)
+	response[4] = byte(dataLength >> 8)
+	response[5] = byte(dataLength)
+	response[6] = aduUnit.unitID
+	response[7] = functionCode | 0x80
+	response[8] = WireExceptionCode(errHandler.ExceptionCode)
+
+	s.logger.Debug("Exception response", F("response", response))
+
+	return response
 }
 
 func (s *server) Fault(errHandler *ErrorHandler, detail string) {
-	log.Println("fault")
+	s.fault(s.logger.With(F("fc", errHandler.FunctionCode)), errHandler, detail)
+}
+
+// fault logs error of request by logger with its fields (function code is one of them)
+func (s *server) fault(l Logger, errHandler *ErrorHandler, detail string) {
+	l.Warn(detail, F("exception", errHandler.ExceptionCode), F("wire_exception", WireExceptionCode(errHandler.ExceptionCode)))
 }
 
 // NewTCPServer ...
 func NewTCPServer(port int, addr string, sm SmartMeter) Server {
-	return &server{port: port, addr: addr, sm: sm}
+	return &server{port: port, addr: addr, sm: sm, logger: defaultLogger}
 }
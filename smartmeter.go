@@ -2,11 +2,12 @@ package modbus
 
 import (
 	"encoding/binary"
-	"encoding/json"
-	"log"
+	"io"
 	"math"
-	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // SmartMeter public interface
@@ -14,44 +15,100 @@ type SmartMeter interface {
 	// Mapping between UnitID (modbus) and NodeID (mqtt)
 	GetNodeID(unitID int) (nodeID string, errHandler ErrorHandler)
 
-	// Get the right topic (mqtt) for specified unitID (modbus) and reg address (modbus)
-	GetTopic(unitID int, regAddr uint16) (topic string, errHandler ErrorHandler)
+	// Get the right topic (mqtt) for specified unitID (modbus), data block and reg address (modbus)
+	GetTopic(unitID int, dataBlock int, regAddr uint16) (topic string, errHandler ErrorHandler)
 
-	// Get value type for specified unitID (modbus) and reg address (modbus)
-	GetValueType(unitID int, regAddr uint16) (valueType int, errHandler ErrorHandler)
+	// Check if unitID (modbus) is mapped to smart meter
+	HasUnitID(unitID int) bool
+
+	// Get value type for specified unitID (modbus), data block and reg address (modbus)
+	GetValueType(unitID int, dataBlock int, regAddr uint16) (valueType int, errHandler ErrorHandler)
 
 	// Get actual value for RHRegister function
 	GetRHRegisterValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler)
 
-	// Check if requested register length (regsNum) for specified reg address (modbus) and unitID (modbus) is correct
-	CheckRegsLength(unitID int, regsNum uint16, regAddr uint16) (tag bool, errHandler ErrorHandler)
+	// Get actual value for RIRegister function
+	GetRIRegisterValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler)
+
+	// Get actual values (packed bits) for ReadCoils function
+	GetCoilsValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler)
+
+	// Get actual values (packed bits) for ReadDiscreteInputs function
+	GetDInputsValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler)
 
-	// Write values to smart meter storage structure (typically from MQTT)
+	// Check if requested register length (regsNum) for specified data block, reg address (modbus) and unitID (modbus) is correct
+	CheckRegsLength(unitID int, dataBlock int, regsNum uint16, regAddr uint16) (tag bool, errHandler ErrorHandler)
+
+	// Write values to smart meter storage structure (typically from MQTT), safe for concurrent use with readers
 	WriteValues(topics string, value string)
+
+	// Write coils (from modbus request), values are sent as commands to MQTT
+	WriteCoilsValue(unitID int, bitAddr uint16, values []bool) (errHandler ErrorHandler)
+
+	// Write holding registers (from modbus request), values are sent as commands to MQTT
+	WriteRHRegistersValue(unitID int, regAddr uint16, regs []byte) (errHandler ErrorHandler)
+
+	// Get age and quality (see @ValueQuality consts) of stored value for specified unitID (modbus), data block and reg address (modbus)
+	GetValueAge(unitID int, dataBlock int, regAddr uint16) (age time.Duration, quality int, errHandler ErrorHandler)
+
+	// Get ages of all stored values (map["nodeID/topic"] = age)
+	GetValueAges() map[string]time.Duration
+
+	// Set channel for commands (pairs of topic and value) which should be published to MQTT, call it before server starts
+	SetCommandChannel(chanCommand chan [2]string)
+
+	// Set logger, see @Logger (call it before server starts)
+	SetLogger(logger Logger)
 }
 
 // Structure including sm storage and mapping, implements SmartMeter interace
 type smartMeter struct {
-	// Storage for smart meter values, typically MQTT (hash map in the form map["nodeID/regNum"] = "string value")
-	smValuesMap map[string]string
+	// Storage for smart meter values, typically MQTT (in the form ["nodeID/regNum"] = "string value"), see @valueStore
+	smValues *valueStore
 
 	// Mapping tables \\
 	// map[unitID] = MappingUnitTable (see @MappingUnitTable)
 	mappUnitTable map[int]MappingUnitTable
 	// existing types of smart meter, see @MappingAllTypeTable and mappUnitTable.smType
 	smTypes []MappingAllTypeTable
+
+	// Topic for commands (written values), see @MappingJSONTable.CommandTopic
+	commandTopic string
+	// Policy for unmapped registers in requested block, see @GapPolicy consts
+	gapPolicy int
+	// Exception code for stale values, see @MappingJSONTable.StaleExceptionCode
+	staleExceptionCode byte
+	// Sentinel for stale values, see @MappingJSONTable.StaleValue
+	staleValue *string
+	// Channel for commands, typically read by MQTT publisher (pairs of topic and value)
+	chanCommand chan [2]string
+	// Commands of one request are sent together, see @sendCommands
+	commandMu sync.Mutex
+	// Logger of smart meter, see @Logger
+	logger Logger
 }
 
 // MappingAllTypeTable specifies type of smart meter, it's a hashmap specifying topic (mqtt) and value type (modbus) for each register (modbus reg num)
 type MappingAllTypeTable struct {
-	// map[registerNum] = MappingTypeTable
-	mType map[int]MappingTypeTable
+	// map[dataBlock][registerNum] = MappingTypeTable, see @DataBlock consts
+	mType map[int]map[int]MappingTypeTable
 }
 
 // MappingTypeTable specifies topic (mapping between modbus reg num and mqtt topic)
 type MappingTypeTable struct {
 	topic   string
 	valType int
+	// Order of bytes and words in registers, see @ByteOrder consts
+	byteOrder int
+	// Access of modbus clients, see @RegisterAccess consts
+	access int
+	// Register value = value * scale + offset, clamped to <min, max> (nil if not limited)
+	scale  float64
+	offset float64
+	min    *float64
+	max    *float64
+	// Max age of value, 0 if max age of unit is used
+	maxAge time.Duration
 }
 
 // MappingUnitTable specifies nodeID (for mqtt topic) and smart meter type for each unitID (see @smartMeter.mappUnitTable)
@@ -59,26 +116,50 @@ type MappingUnitTable struct {
 	nodeID string
 	// Index to @smartMeter.smTypes table, specifies type of smart meter
 	smType int
+	// Max age of values of this unit, 0 if values do not expire
+	maxAge time.Duration
 }
 
 /*-------------------------*\
 -----JSON TMP STRUCTURES-----
 ----------------------------*/
 
-// MappingJSONRegisters - see example conf.json.comment file
+// MappingJSONRegisters - legacy layout of type with parallel arrays, see @ConfigJSON for structured layout
 type MappingJSONRegisters struct {
 	Numbers []int
 	Topics  []string
 	// Selected value type, see @ValueType consts
 	ValueTypes []int
+	// Data block of each register, see @DataBlock consts (optional, holding registers if empty)
+	DataBlocks []int
+	// Byte order of each register, "ABCD", "DCBA", "BADC" or "CDAB" (optional, "ABCD" if empty)
+	ByteOrders []string
+	// Scale factor and offset of each register, value * scale + offset is encoded (optional, 1 and 0 if empty)
+	Scales  []float64
+	Offsets []float64
+	// Clamp range of each scaled value, null if not limited (optional)
+	Mins []*float64
+	Maxs []*float64
+	// Max age of each value in seconds, 0 if max age of unit is used (optional)
+	MaxAges []int
 }
 
-// MappingJSONTable - see example conf.json.comment file
+// MappingJSONTable - legacy layout of config with parallel arrays, it is converted to @ConfigJSON by @LoadConfig
 type MappingJSONTable struct {
 	UnitID []int
 	NodeID []string
 	Type   []int
 	Types  []MappingJSONRegisters
+	// Topic for publishing written values, {nodeID} and {topic} are replaced (optional, see @DefaultCommandTopic)
+	CommandTopic string
+	// How to read unmapped registers inside requested block, see @GapPolicy consts
+	GapPolicy int
+	// Max age of values in seconds for each unit, 0 if values do not expire (optional)
+	MaxAges []int
+	// Exception code for stale values (optional, GatewayTargetDeviceFailedToRespond if it is 0)
+	StaleExceptionCode int
+	// Sentinel value returned instead of stale values, exception is returned if it is null (optional)
+	StaleValue *string
 }
 
 /*-------------------------*\
@@ -87,80 +168,192 @@ type MappingJSONTable struct {
 
 // ValueTypes for registers, see above
 const (
-	ValueTypeFLOAT    = 1
-	ValueTypeSIGNED   = 2
+	// float32, 2 registers
+	ValueTypeFLOAT = 1
+	// int32, 2 registers
+	ValueTypeSIGNED = 2
+	// uint32, 2 registers
 	ValueTypeUNSIGNED = 3
+	// Only for coils and discrete inputs, payload "0/1/true/false"
+	ValueTypeBOOL = 4
+	// 1 register
+	ValueTypeINT16  = 5
+	ValueTypeUINT16 = 6
+	// 4 registers
+	ValueTypeINT64   = 7
+	ValueTypeUINT64  = 8
+	ValueTypeFLOAT64 = 9
+
+	// Aliases with explicit width
+	ValueTypeFLOAT32 = ValueTypeFLOAT
+	ValueTypeINT32   = ValueTypeSIGNED
+	ValueTypeUINT32  = ValueTypeUNSIGNED
+)
+
+// ByteOrders of values in registers, A is the most significant byte of value
+const (
+	// Big endian, modbus default
+	ByteOrderABCD = 0
+	// Little endian
+	ByteOrderDCBA = 1
+	// Big endian with swapped bytes in each register
+	ByteOrderBADC = 2
+	// Big endian with swapped registers (words)
+	ByteOrderCDAB = 3
+)
+
+// byteOrderNames maps names of byte orders in config to @ByteOrder consts
+var byteOrderNames = map[string]int{
+	"ABCD": ByteOrderABCD,
+	"DCBA": ByteOrderDCBA,
+	"BADC": ByteOrderBADC,
+	"CDAB": ByteOrderCDAB,
+}
+
+// GapPolicies for unmapped registers (or bits) inside requested block
+const (
+	// Whole request fails with IllegalDataAddress exception
+	GapPolicyIllegalAddress = 0
+	// Unmapped registers are read as zeros (at least one register must be mapped)
+	GapPolicyZeroFill = 1
+)
+
+// DefaultCommandTopic is used for publishing written values if config does not specify CommandTopic
+const DefaultCommandTopic = "/modbus/{nodeID}/{topic}/set"
+
+// maxValueTypeLength is the longest value type in registers, see @valueTypeLength
+const maxValueTypeLength = 4
+
+// valueTypeLength returns number of registers (or bits for ValueTypeBOOL) occupied by value type, 0 for unknown type
+func valueTypeLength(valueType int) uint16 {
+	switch valueType {
+	case ValueTypeBOOL, ValueTypeINT16, ValueTypeUINT16:
+		return 1
+	case ValueTypeFLOAT, ValueTypeSIGNED, ValueTypeUNSIGNED:
+		return 2
+	case ValueTypeINT64, ValueTypeUINT64, ValueTypeFLOAT64:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// ValueQualities of stored values, see @GetValueAge
+const (
+	ValueQualityGood = 0
+	// Value is older than its max age
+	ValueQualityStale = 1
+	// Value was not received yet
+	ValueQualityMissing = 2
+)
+
+// DataBlocks (modbus data model) in which register numbers live
+const (
+	DataBlockHoldingRegisters = 0
+	DataBlockInputRegisters   = 1
+	DataBlockCoils            = 2
+	DataBlockDiscreteInputs   = 3
 )
 
 /**
 * NewSmartMeter set smart meter configuration
-* @param config string path to config file, see @conf.json as example file
-* return &smartMeter
+* @param config string path to config file, see @conf.json as example file (legacy layout is converted, see @LoadConfig)
+* @return error *os.PathError if file can not be opened, *ConfigSyntaxError if it can not be decoded, ConfigErrors with all invalid items
  */
-func NewSmartMeter(config string) SmartMeter {
-
-	// Get config
-	file, _ := os.Open(config)
-	decoder := json.NewDecoder(file)
-	var mapp MappingJSONTable
-	// Read JSON config into MappingJSONTable structure
-	err := decoder.Decode(&mapp)
-	file.Close()
-	// Check decodig status
+func NewSmartMeter(config string) (SmartMeter, error) {
+
+	mapp, err := LoadConfig(config)
 	if err != nil {
-		log.Println("Config error (file was not succefully decoded): ", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	// Length of this two arraus must be the same, se @conf.json file
-	if len(mapp.Type) != len(mapp.Types) {
-		log.Println("Invalid config file, type length != types length!")
-		os.Exit(1)
+	return newSmartMeter(mapp), nil
+}
+
+/**
+* NewSmartMeterFromReader set smart meter configuration from reader
+* @param r io.Reader with config (JSON), see @ReadConfig
+* @return error *ConfigSyntaxError if config can not be decoded, ConfigErrors with all invalid items
+ */
+func NewSmartMeterFromReader(r io.Reader) (SmartMeter, error) {
+
+	mapp, err := ReadConfig(r)
+	if err != nil {
+		return nil, err
 	}
 
-	if LoggerEnable {
-		log.Println("Converting config file to smart meter structure...")
+	return newSmartMeter(mapp), nil
+}
+
+/**
+* NewSmartMeterFromConfig set smart meter configuration built in code
+* @param mapp *ConfigJSON config, see @ConfigJSON
+* @return error ConfigErrors with all invalid items
+ */
+func NewSmartMeterFromConfig(mapp *ConfigJSON) (SmartMeter, error) {
+
+	if err := mapp.validate().result(); err != nil {
+		return nil, err
 	}
 
-	// Convert to SmartMeter
+	return newSmartMeter(mapp), nil
+}
+
+// newSmartMeter converts validated config to smart meter
+func newSmartMeter(mapp *ConfigJSON) *smartMeter {
 
-	smartMeterNum := len(mapp.UnitID) // Number of devices, ie. number of mappings
 	// Create sm mapp for unitIDs
 	smMap := make(map[int]MappingUnitTable)
-	for index := 0; index < smartMeterNum; index++ {
-		mappUnitTable := MappingUnitTable{mapp.NodeID[index], mapp.Type[index]}
-		smMap[mapp.UnitID[index]] = mappUnitTable
+	for _, device := range mapp.Devices {
+		smMap[device.UnitID] = MappingUnitTable{nodeID: device.NodeID, smType: device.Type, maxAge: time.Duration(device.MaxAge) * time.Second}
 	}
 
-	typesNum := len(mapp.Types)
 	// Create sm mapp for smart meter types
-	smTypes := make([]MappingAllTypeTable, typesNum)
-	for index := 0; index < typesNum; index++ {
-		smTypes[index].mType = make(map[int]MappingTypeTable)
-
-		// For each type create mapp for registers
-		typesLen := len(mapp.Types[index].Numbers)
-		for t := 0; t < typesLen; t++ {
-			smTypes[index].mType[mapp.Types[index].Numbers[t]] = MappingTypeTable{mapp.Types[index].Topics[t], mapp.Types[index].ValueTypes[t]}
-		}
+	smTypes := buildTypes(mapp.Types)
+
+	commandTopic := mapp.CommandTopic
+	if commandTopic == "" {
+		commandTopic = DefaultCommandTopic
+	}
+
+	staleExceptionCode := mapp.StaleExceptionCode
+	if staleExceptionCode == 0 {
+		staleExceptionCode = ExceptionCodeGatewayTargetDeviceFailedToRespond
 	}
 
 	// Return smart meters
-	return &smartMeter{smValuesMap: make(map[string]string), mappUnitTable: smMap, smTypes: smTypes}
+	return &smartMeter{smValues: newValueStore(), mappUnitTable: smMap, smTypes: smTypes, commandTopic: commandTopic, gapPolicy: mapp.GapPolicy,
+		staleExceptionCode: byte(staleExceptionCode), staleValue: mapp.StaleValue, logger: defaultLogger}
+}
+
+// HasUnitID checks if unit ID is mapped, it does not log anything (requests for other units are usual on serial line)
+func (sm *smartMeter) HasUnitID(unitID int) bool {
+	_, flag := sm.mappUnitTable[unitID]
+	return flag
 }
 
 func (sm *smartMeter) checkUnitID(unitID int) (errHandler ErrorHandler) {
 
 	_, flag := sm.mappUnitTable[unitID]
 	if flag == false {
-		log.Println("Bad unit ID, not present")
+		sm.logger.Warn("Bad unit ID, not present")
 		errHandler.ExceptionCode = ExceptionCodeBadUnitID
 		return errHandler
 	}
 	return errHandler
 }
 
-func (sm *smartMeter) checkRegAddress(unitID int, regAddr uint16) (errHandler ErrorHandler) {
+// checkAddressRange checks that requested block of registers (coils) does not exceed address 65535 (addresses would wrap to 0)
+func (sm *smartMeter) checkAddressRange(addr uint16, quantity uint16) (errHandler ErrorHandler) {
+
+	if uint32(addr)+uint32(quantity) > 0x10000 {
+		sm.logger.Warn("Requested block exceeds address 65535", F("address", addr), F("quantity", quantity))
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+	}
+	return errHandler
+}
+
+func (sm *smartMeter) checkRegAddress(unitID int, dataBlock int, regAddr uint16) (errHandler ErrorHandler) {
 
 	errHandler = sm.checkUnitID(unitID)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
@@ -168,9 +361,9 @@ func (sm *smartMeter) checkRegAddress(unitID int, regAddr uint16) (errHandler Er
 	}
 
 	//TODO first check sm type
-	_, flag := sm.smTypes[sm.mappUnitTable[unitID].smType].mType[int(regAddr)]
+	_, flag := sm.smTypes[sm.mappUnitTable[unitID].smType].mType[dataBlock][int(regAddr)]
 	if flag == false {
-		log.Println("Bad register address, not supported")
+		sm.logger.Warn("Bad register address, not supported")
 		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
 	}
 
@@ -197,67 +390,61 @@ func (sm *smartMeter) GetNodeID(unitID int) (nodeID string, errHandler ErrorHand
 /**
 * GetTopic
 * @param unitID unit ID from modbus request
+* @param dataBlock data block addressed by modbus request (see @DataBlock consts)
 * @param regAddr register address from modbus request
 * @return topic string right topic for unitID and specific register address
  */
-func (sm *smartMeter) GetTopic(unitID int, regAddr uint16) (topic string, errHandler ErrorHandler) {
+func (sm *smartMeter) GetTopic(unitID int, dataBlock int, regAddr uint16) (topic string, errHandler ErrorHandler) {
 
 	// Check reg address
-	errHandler = sm.checkRegAddress(unitID, regAddr)
+	errHandler = sm.checkRegAddress(unitID, dataBlock, regAddr)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
 		return "", errHandler
 	}
 
 	// If everything is ok, you can access and return topic
-	return sm.smTypes[sm.mappUnitTable[unitID].smType].mType[int(regAddr)].topic, errHandler
+	return sm.smTypes[sm.mappUnitTable[unitID].smType].mType[dataBlock][int(regAddr)].topic, errHandler
 }
 
 /**
 * GetValueType
 * @param unitID unit ID from modbus request
+* @param dataBlock data block addressed by modbus request (see @DataBlock consts)
 * @param regAddr register address from modbus request
 * @return valueType int right value type for unitID and specific register address
  */
-func (sm *smartMeter) GetValueType(unitID int, regAddr uint16) (valueType int, errHandler ErrorHandler) {
+func (sm *smartMeter) GetValueType(unitID int, dataBlock int, regAddr uint16) (valueType int, errHandler ErrorHandler) {
 
 	// Check reg address
-	errHandler = sm.checkRegAddress(unitID, regAddr)
+	errHandler = sm.checkRegAddress(unitID, dataBlock, regAddr)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
 		return -1, errHandler
 	}
 
 	// If everything is ok, you can access and return value type
-	return sm.smTypes[sm.mappUnitTable[unitID].smType].mType[int(regAddr)].valType, errHandler
+	return sm.smTypes[sm.mappUnitTable[unitID].smType].mType[dataBlock][int(regAddr)].valType, errHandler
 }
 
 /**
 * GetValueType
 * @param unitID unit ID from modbus request
+* @param dataBlock data block addressed by modbus request (see @DataBlock consts)
 * @param regNum requested register length/number from modbus request
 * @param regAddr register address from modbus request
 * @return tag bool true if it is ok, else false
  */
-func (sm *smartMeter) CheckRegsLength(unitID int, regsNum uint16, regAddr uint16) (tag bool, errHandler ErrorHandler) {
+func (sm *smartMeter) CheckRegsLength(unitID int, dataBlock int, regsNum uint16, regAddr uint16) (tag bool, errHandler ErrorHandler) {
 
 	// Get and check value type
-	valType, errHandler := sm.GetValueType(unitID, regAddr)
+	valType, errHandler := sm.GetValueType(unitID, dataBlock, regAddr)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
 		return false, errHandler
 	}
 
-	// According value type check register length
-	switch valType {
-	case ValueTypeFLOAT:
-	case ValueTypeSIGNED:
-	case ValueTypeUNSIGNED:
-		// These values should be all 4 bytes
-		if regsNum != 4 {
-			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
-			return false, errHandler
-		}
-		break
-	default:
-
+	// According value type check register length, value must be read or written whole
+	if regsNum != valueTypeLength(valType) {
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+		return false, errHandler
 	}
 
 	return true, errHandler
@@ -271,16 +458,33 @@ func (sm *smartMeter) CheckRegsLength(unitID int, regsNum uint16, regAddr uint16
  */
 func (sm *smartMeter) GetRHRegisterValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler) {
 
-	if LoggerEnable {
-		log.Println("Getting RHRegs values from smart meter...")
-	}
+	sm.logger.Debug("Getting RHRegs values from smart meter...")
+
+	return sm.getRegisterValue(data, unitID, DataBlockHoldingRegisters)
+}
+
+/**
+* GetRIRegisterValue
+* @param data byte array from modbus request (including reg address and requested length)
+* @param unitID unit id from modbus request
+* @return value []byte value for specific register
+ */
+func (sm *smartMeter) GetRIRegisterValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler) {
+
+	sm.logger.Debug("Getting RIRegs values from smart meter...")
+
+	return sm.getRegisterValue(data, unitID, DataBlockInputRegisters)
+}
+
+// getRegisterValue reads values of requested block of registers in specified data block, common part for RHRegs and RIRegs
+func (sm *smartMeter) getRegisterValue(data []byte, unitID int, dataBlock int) (value []byte, errHandler ErrorHandler) {
 
 	// Get length of Data
 	dataLength := len(data)
 
-	// Data for RHRegs = address (2B) + regNum (2B)
+	// Data for RHRegs/RIRegs = address (2B) + regNum (2B)
 	if dataLength != 4 {
-		log.Println("Bad data length for RHRegs function")
+		sm.logger.Warn("Bad data length for registers function")
 		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
 		return nil, errHandler
 	}
@@ -289,76 +493,613 @@ func (sm *smartMeter) GetRHRegisterValue(data []byte, unitID int) (value []byte,
 	regAddr := binary.BigEndian.Uint16(data)
 	regsNum := binary.BigEndian.Uint16(data[2:])
 
-	// Check requested number of registers to read (including register address)
-	t, errHandler := sm.CheckRegsLength(unitID, regsNum, regAddr)
+	errHandler = sm.checkAddressRange(regAddr, regsNum)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return nil, errHandler
+	}
 
+	nodeID, errHandler := sm.GetNodeID(unitID)
 	if errHandler.ExceptionCode != ExceptionCodeSuccess {
 		return nil, errHandler
 	}
-	if t == false {
-		log.Println("Invalid registers number")
-		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+
+	// Requested block can not start in the middle of value
+	for back := uint16(1); back < maxValueTypeLength && back <= regAddr; back++ {
+		mapping, flag := sm.lookupRegister(unitID, dataBlock, regAddr-back)
+		if flag && valueTypeLength(mapping.valType) > back {
+			sm.logger.Warn("Register address is in the middle of value", F("register", regAddr), F("value_register", regAddr-back))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return nil, errHandler
+		}
+	}
+
+	// Lay out mapped values by their length, gaps are handled according to gap policy
+	value = make([]byte, int(regsNum)*2)
+	mappedNum := 0
+	for offset := uint16(0); offset < regsNum; {
+		mapping, flag := sm.lookupRegister(unitID, dataBlock, regAddr+offset)
+		if flag == false {
+			if sm.gapPolicy != GapPolicyZeroFill {
+				sm.logger.Warn("Bad register address, not supported", F("register", regAddr+offset))
+				errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+				return nil, errHandler
+			}
+			offset++
+			continue
+		}
+
+		// Write only registers can not be read
+		if mapping.access == RegisterAccessWrite {
+			sm.logger.Warn("Register is write only", F("register", regAddr+offset))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return nil, errHandler
+		}
+
+		// Requested block can not end in the middle of value
+		length := valueTypeLength(mapping.valType)
+		if offset+length > regsNum {
+			sm.logger.Warn("Requested registers end in the middle of value", F("value_register", regAddr+offset))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return nil, errHandler
+		}
+
+		sm.logger.Debug("Get nodeID and topicID", F("node", nodeID), F("topic", mapping.topic))
+
+		valueString, errHandler := sm.loadValue(unitID, nodeID, mapping)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return nil, errHandler
+		}
+
+		regs, errHandler := encodeRegisterValue(sm.logger, mapping, valueString)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return nil, errHandler
+		}
+		copy(value[offset*2:], regs)
+
+		offset += length
+		mappedNum++
+	}
+
+	// Block including only gaps is not valid at all
+	if mappedNum == 0 {
+		sm.logger.Warn("There are no mapped registers in requested block")
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+		return nil, errHandler
+	}
+
+	return value, errHandler
+}
+
+// encodeRegisterValue converts string value (typically from MQTT) to registers according to register mapping (value type, scaling and byte order)
+func encodeRegisterValue(logger Logger, mapping MappingTypeTable, valueString string) (value []byte, errHandler ErrorHandler) {
+
+	valueType := mapping.valType
+
+	logger.Debug("Get value type and value string", F("value_type", valueType), F("value", valueString))
+	logger.Debug("Parsing string value...")
+
+	// Get value bits (in uint64) from string value
+	var valueBits uint64
+	var err error
+	if mapping.isScaled() {
+		valueBits, errHandler = scaleValue(logger, mapping, valueString)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return nil, errHandler
+		}
+	} else {
+		switch valueType {
+		case ValueTypeFLOAT:
+			var valueFloat float64
+			valueFloat, err = strconv.ParseFloat(valueString, 32)
+			valueBits = uint64(math.Float32bits(float32(valueFloat)))
+		case ValueTypeFLOAT64:
+			var valueFloat float64
+			valueFloat, err = strconv.ParseFloat(valueString, 64)
+			valueBits = math.Float64bits(valueFloat)
+		case ValueTypeINT16, ValueTypeSIGNED, ValueTypeINT64:
+			var valueInt int64
+			valueInt, err = strconv.ParseInt(valueString, 10, int(valueTypeLength(valueType))*16)
+			valueBits = uint64(valueInt)
+		case ValueTypeUINT16, ValueTypeUNSIGNED, ValueTypeUINT64:
+			valueBits, err = strconv.ParseUint(valueString, 10, int(valueTypeLength(valueType))*16)
+		default:
+			logger.Warn("Unsupported value type for reading", F("value_type", valueType))
+			errHandler.ExceptionCode = ExceptionCodeCreationError
+			return nil, errHandler
+		}
+	}
+
+	if err != nil {
+		logger.Warn("Parsing value was not succesfull", F("value_type", valueType), F("value", valueString), F("error", err))
+		errHandler.ExceptionCode = ExceptionCodeCreationError
+		// Value does not fit to value type
+		if numErr, flag := err.(*strconv.NumError); flag && numErr.Err == strconv.ErrRange {
+			errHandler.ExceptionCode = ExceptionCodeValueOverflow
+		}
 		return nil, errHandler
 	}
 
-	// We do not have to check errHandler, because we check it above in CheckRegsLength function
-	nodeID, _ := sm.GetNodeID(unitID)
-	topic, _ := sm.GetTopic(unitID, regAddr)
+	// Put value to big endian registers, value fills all its registers
+	value = make([]byte, 8)
+	binary.BigEndian.PutUint64(value, valueBits)
+	value = value[8-valueTypeLength(valueType)*2:]
+
+	logger.Debug("Parsed value from string", F("value", valueString), F("bits", valueBits), F("bytes", value))
+
+	return applyByteOrder(value, mapping.byteOrder), errHandler
+}
+
+// isScaled checks if value of register has to be scaled, shifted or clamped
+func (mapping MappingTypeTable) isScaled() bool {
+	return mapping.scale != 1 || mapping.offset != 0 || mapping.min != nil || mapping.max != nil
+}
+
+// scaleValue converts engineering value to raw value (value * scale + offset, clamped) and returns its bits according to value type
+func scaleValue(logger Logger, mapping MappingTypeTable, valueString string) (valueBits uint64, errHandler ErrorHandler) {
+
+	valueFloat, err := strconv.ParseFloat(strings.TrimSpace(valueString), 64)
+	if err != nil {
+		logger.Warn("Parsing scaled value was not succesfull", F("value", valueString), F("error", err))
+		errHandler.ExceptionCode = ExceptionCodeCreationError
+		return 0, errHandler
+	}
+
+	valueFloat = valueFloat*mapping.scale + mapping.offset
+	if mapping.min != nil && valueFloat < *mapping.min {
+		valueFloat = *mapping.min
+	}
+	if mapping.max != nil && valueFloat > *mapping.max {
+		valueFloat = *mapping.max
+	}
+
+	// Floats are used directly, integers are rounded and checked for range (bits - 1 for sign)
+	bits := int(valueTypeLength(mapping.valType)) * 16
+	switch mapping.valType {
+	case ValueTypeFLOAT:
+		if math.Abs(valueFloat) > math.MaxFloat32 {
+			break
+		}
+		return uint64(math.Float32bits(float32(valueFloat))), errHandler
+	case ValueTypeFLOAT64:
+		return math.Float64bits(valueFloat), errHandler
+	case ValueTypeINT16, ValueTypeSIGNED, ValueTypeINT64:
+		valueFloat = math.Round(valueFloat)
+		if valueFloat < -math.Ldexp(1, bits-1) || valueFloat >= math.Ldexp(1, bits-1) {
+			break
+		}
+		return uint64(int64(valueFloat)), errHandler
+	case ValueTypeUINT16, ValueTypeUNSIGNED, ValueTypeUINT64:
+		valueFloat = math.Round(valueFloat)
+		if valueFloat < 0 || valueFloat >= math.Ldexp(1, bits) {
+			break
+		}
+		return uint64(valueFloat), errHandler
+	default:
+		logger.Warn("Unsupported value type for scaling", F("value_type", mapping.valType))
+		errHandler.ExceptionCode = ExceptionCodeCreationError
+		return 0, errHandler
+	}
+
+	logger.Warn("Scaled value is out of range of value type", F("scaled", valueFloat), F("value", valueString), F("value_type", mapping.valType))
+	errHandler.ExceptionCode = ExceptionCodeValueOverflow
+	return 0, errHandler
+}
+
+// applyByteOrder reorders big endian (ABCD) value to byte order or back, value is reordered in place
+func applyByteOrder(value []byte, byteOrder int) []byte {
+
+	// Swap registers (words)
+	if byteOrder == ByteOrderCDAB || byteOrder == ByteOrderDCBA {
+		for i, j := 0, len(value)-2; i < j; i, j = i+2, j-2 {
+			value[i], value[i+1], value[j], value[j+1] = value[j], value[j+1], value[i], value[i+1]
+		}
+	}
 
-	if LoggerEnable {
-		log.Printf("Get nodeID (%s) and topicID (%s)\n", nodeID, topic)
+	// Swap bytes in each register
+	if byteOrder == ByteOrderBADC || byteOrder == ByteOrderDCBA {
+		for i := 0; i+1 < len(value); i += 2 {
+			value[i], value[i+1] = value[i+1], value[i]
+		}
 	}
 
-	valueType, _ := sm.GetValueType(unitID, regAddr) // We do not have to check errHandler, because we check it above in CheckRegsLength function
-	valueString, flag := sm.smValuesMap[nodeID+"/"+topic]
+	return value
+}
+
+// loadValue gets stored value of register, missing and stale values are reported as exceptions (or stale value is replaced by sentinel)
+func (sm *smartMeter) loadValue(unitID int, nodeID string, mapping MappingTypeTable) (valueString string, errHandler ErrorHandler) {
+
+	valueString, received, flag := sm.smValues.Load(nodeID + "/" + mapping.topic)
 	if flag == false {
-		log.Println("Values for this topic are not present in the buffer")
+		sm.logger.Warn("Values for this topic are not present in the buffer", F("topic", nodeID+"/"+mapping.topic))
 		errHandler.ExceptionCode = ExceptionCodeGatewayTargetDeviceFailedToRespond //TODO is that the right response?
+		return "", errHandler
+	}
+
+	if sm.getQuality(unitID, mapping, received) == ValueQualityStale {
+		if sm.staleValue != nil {
+			return *sm.staleValue, errHandler
+		}
+		sm.logger.Warn("Value is stale", F("topic", nodeID+"/"+mapping.topic), F("received", received))
+		errHandler.ExceptionCode = sm.staleExceptionCode
+		return "", errHandler
+	}
+
+	return valueString, errHandler
+}
+
+// getQuality checks if value received in specified time is stale according to max age of register (or unit)
+func (sm *smartMeter) getQuality(unitID int, mapping MappingTypeTable, received time.Time) int {
+
+	maxAge := mapping.maxAge
+	if maxAge == 0 {
+		maxAge = sm.mappUnitTable[unitID].maxAge
+	}
+
+	if maxAge != 0 && time.Since(received) > maxAge {
+		return ValueQualityStale
+	}
+	return ValueQualityGood
+}
+
+/**
+* GetValueAge
+* @param unitID unit ID from modbus request
+* @param dataBlock data block of register (see @DataBlock consts)
+* @param regAddr register address
+* @return age time.Duration age of stored value (0 if value is missing)
+* @return quality int quality of stored value, see @ValueQuality consts
+ */
+func (sm *smartMeter) GetValueAge(unitID int, dataBlock int, regAddr uint16) (age time.Duration, quality int, errHandler ErrorHandler) {
+
+	// Check reg address
+	errHandler = sm.checkRegAddress(unitID, dataBlock, regAddr)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return 0, ValueQualityMissing, errHandler
+	}
+
+	mapping, _ := sm.lookupRegister(unitID, dataBlock, regAddr)
+	_, received, flag := sm.smValues.Load(sm.mappUnitTable[unitID].nodeID + "/" + mapping.topic)
+	if flag == false {
+		return 0, ValueQualityMissing, errHandler
+	}
+
+	return time.Since(received), sm.getQuality(unitID, mapping, received), errHandler
+}
+
+/**
+* GetValueAges
+* @return ages map[string]time.Duration ages of all stored values (key is "nodeID/topic")
+ */
+func (sm *smartMeter) GetValueAges() map[string]time.Duration {
+	return sm.smValues.Ages()
+}
+
+// lookupRegister gets mapping of register without any checks (unitID must be valid)
+func (sm *smartMeter) lookupRegister(unitID int, dataBlock int, regAddr uint16) (mapping MappingTypeTable, flag bool) {
+	mapping, flag = sm.smTypes[sm.mappUnitTable[unitID].smType].mType[dataBlock][int(regAddr)]
+	return mapping, flag
+}
+
+/**
+* GetCoilsValue
+* @param data byte array from modbus request (including address and requested quantity)
+* @param unitID unit id from modbus request
+* @return value []byte packed coils values (first coil in LSB of first byte)
+ */
+func (sm *smartMeter) GetCoilsValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler) {
+
+	sm.logger.Debug("Getting coils values from smart meter...")
+
+	return sm.getBitsValue(data, unitID, DataBlockCoils)
+}
+
+/**
+* GetDInputsValue
+* @param data byte array from modbus request (including address and requested quantity)
+* @param unitID unit id from modbus request
+* @return value []byte packed discrete inputs values (first input in LSB of first byte)
+ */
+func (sm *smartMeter) GetDInputsValue(data []byte, unitID int) (value []byte, errHandler ErrorHandler) {
+
+	sm.logger.Debug("Getting discrete inputs values from smart meter...")
+
+	return sm.getBitsValue(data, unitID, DataBlockDiscreteInputs)
+}
+
+// getBitsValue reads and packs values of bits in specified data block, common part for coils and discrete inputs
+func (sm *smartMeter) getBitsValue(data []byte, unitID int, dataBlock int) (value []byte, errHandler ErrorHandler) {
+
+	// Data for coils/discrete inputs = address (2B) + quantity (2B)
+	if len(data) != 4 {
+		sm.logger.Warn("Bad data length for bits function")
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
 		return nil, errHandler
-		//TODO bad topics
 	}
 
-	if LoggerEnable {
-		log.Printf("Get value type (%d) and value string (%s)\n", valueType, valueString)
-		log.Println("Parsing string value...")
+	// Read values from data buffer, see above (addr + quantity)
+	bitAddr := binary.BigEndian.Uint16(data)
+	bitsNum := binary.BigEndian.Uint16(data[2:])
+
+	if bitsNum < 1 || bitsNum > 2000 {
+		sm.logger.Warn("Invalid bits number")
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+		return nil, errHandler
 	}
 
-	// TODO
-	switch valueType {
-	case ValueTypeFLOAT:
-		valueFloat, err := strconv.ParseFloat(valueString, 32)
+	errHandler = sm.checkAddressRange(bitAddr, bitsNum)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return nil, errHandler
+	}
+
+	nodeID, errHandler := sm.GetNodeID(unitID)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return nil, errHandler
+	}
+
+	// 8 bits in one byte, last byte is padded with zeros, gaps are handled according to gap policy
+	value = make([]byte, (bitsNum+7)/8)
+	mappedNum := 0
+	for i := uint16(0); i < bitsNum; i++ {
+		mapping, flag := sm.lookupRegister(unitID, dataBlock, bitAddr+i)
+		if flag == false {
+			if sm.gapPolicy != GapPolicyZeroFill {
+				sm.logger.Warn("Bad bit address, not supported", F("register", bitAddr+i))
+				errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+				return nil, errHandler
+			}
+			continue
+		}
+		if mapping.access == RegisterAccessWrite {
+			sm.logger.Warn("Bit is write only", F("register", bitAddr+i))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return nil, errHandler
+		}
+		mappedNum++
+
+		valueString, errHandler := sm.loadValue(unitID, nodeID, mapping)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return nil, errHandler
+		}
+
+		valueBool, err := parseBool(valueString)
 		if err != nil {
-			log.Printf("Parsing float value from %s was not succesfull %s", valueString, err.Error())
+			sm.logger.Warn("Parsing bool value was not succesfull", F("value", valueString), F("error", err))
 			errHandler.ExceptionCode = ExceptionCodeCreationError
-			//TODO maybe response error?
 			return nil, errHandler
 		}
-		valueBits := math.Float32bits(float32(valueFloat))
-		value = make([]byte, 4)
-		binary.LittleEndian.PutUint32(value, valueBits)
-		if LoggerEnable {
-			log.Printf("Parsed float value %f from string %s, converted to bits %d and finally to bytes %s", valueFloat, valueString, valueBits, value)
+
+		if valueBool {
+			value[i/8] |= 1 << (i % 8)
 		}
-		break
-	case ValueTypeSIGNED:
-	case ValueTypeUNSIGNED:
-		//TODO
-	default:
-		break
 	}
 
+	// Block including only gaps is not valid at all
+	if mappedNum == 0 {
+		sm.logger.Warn("There are no mapped bits in requested block")
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+		return nil, errHandler
+	}
+
+	sm.logger.Debug("Packed bits", F("quantity", bitsNum), F("register", bitAddr), F("bytes", value))
+
 	return value, errHandler
 }
 
+// parseBool parses MQTT payload for bits, ie. "0/1/true/false" (numbers different from 0 are true)
+func parseBool(valueString string) (bool, error) {
+	valueString = strings.TrimSpace(valueString)
+
+	valueBool, err := strconv.ParseBool(valueString)
+	if err == nil {
+		return valueBool, nil
+	}
+
+	valueFloat, errFloat := strconv.ParseFloat(valueString, 64)
+	if errFloat != nil {
+		return false, err
+	}
+	return valueFloat != 0, nil
+}
+
 /**
 * WriteValues
 * @param topics topics identifier and key for storing
 * @param value string value to store
  */
 func (sm *smartMeter) WriteValues(topics string, value string) {
-	if LoggerEnable {
-		log.Printf("Writing value %s for topic %s\n", value, topics)
+	sm.logger.Debug("Writing value", F("topic", topics), F("value", value))
+
+	sm.smValues.Store(topics, value)
+}
+
+/**
+* SetCommandChannel
+* @param chanCommand channel for creating pipe between smart meter and mqtt publisher, it must be buffered
+* (write of more values needs space for all of them) and nobody else can send to it
+ */
+func (sm *smartMeter) SetCommandChannel(chanCommand chan [2]string) {
+	sm.chanCommand = chanCommand
+}
+
+/**
+* SetLogger
+* @param logger logger for messages of smart meter
+ */
+func (sm *smartMeter) SetLogger(logger Logger) {
+	sm.logger = logger
+}
+
+/**
+* WriteCoilsValue
+* @param unitID unit id from modbus request
+* @param bitAddr address of first coil from modbus request
+* @param values values of coils to write
+* @return errHandler
+ */
+func (sm *smartMeter) WriteCoilsValue(unitID int, bitAddr uint16, values []bool) (errHandler ErrorHandler) {
+
+	sm.logger.Debug("Writing coils...", F("quantity", len(values)), F("register", bitAddr))
+
+	errHandler = sm.checkAddressRange(bitAddr, uint16(len(values)))
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return errHandler
+	}
+
+	nodeID, errHandler := sm.GetNodeID(unitID)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return errHandler
+	}
+
+	// Check all coils first, nothing is sent if one of them is not mapped
+	commands := make([][2]string, 0, len(values))
+	for i, valueBool := range values {
+		errHandler := sm.checkRegAddress(unitID, DataBlockCoils, bitAddr+uint16(i))
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return errHandler
+		}
+		mapping, _ := sm.lookupRegister(unitID, DataBlockCoils, bitAddr+uint16(i))
+		if mapping.access == RegisterAccessRead {
+			sm.logger.Warn("Coil is read only", F("register", bitAddr+uint16(i)))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return errHandler
+		}
+		commands = append(commands, [2]string{sm.getCommandTopic(nodeID, mapping.topic), strconv.FormatBool(valueBool)})
+	}
+
+	return sm.sendCommands(commands)
+}
+
+/**
+* WriteRHRegistersValue
+* @param unitID unit id from modbus request
+* @param regAddr address of first register from modbus request
+* @param regs registers values from modbus request (2 bytes for each register)
+* @return errHandler
+ */
+func (sm *smartMeter) WriteRHRegistersValue(unitID int, regAddr uint16, regs []byte) (errHandler ErrorHandler) {
+
+	sm.logger.Debug("Writing registers...", F("quantity", len(regs)/2), F("register", regAddr))
+
+	errHandler = sm.checkAddressRange(regAddr, uint16(len(regs)/2))
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return errHandler
+	}
+
+	nodeID, errHandler := sm.GetNodeID(unitID)
+	if errHandler.ExceptionCode != ExceptionCodeSuccess {
+		return errHandler
 	}
 
-	sm.smValuesMap[topics] = value
+	// Requested registers can include more values, each one must be written whole
+	regsNum := uint16(len(regs) / 2)
+	commands := make([][2]string, 0, regsNum)
+	for offset := uint16(0); offset < regsNum; {
+		errHandler := sm.checkRegAddress(unitID, DataBlockHoldingRegisters, regAddr+offset)
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return errHandler
+		}
+
+		mapping, _ := sm.lookupRegister(unitID, DataBlockHoldingRegisters, regAddr+offset)
+		// Read only registers can not be written
+		if mapping.access == RegisterAccessRead {
+			sm.logger.Warn("Register is read only", F("register", regAddr+offset))
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+			return errHandler
+		}
+		length := valueTypeLength(mapping.valType)
+		if offset+length > regsNum {
+			sm.logger.Warn("Invalid registers number, value is not written whole")
+			errHandler.ExceptionCode = ExceptionCodeIllegalDataValue
+			return errHandler
+		}
+
+		valueString, errHandler := decodeRegisterValue(sm.logger, mapping, regs[offset*2:(offset+length)*2])
+		if errHandler.ExceptionCode != ExceptionCodeSuccess {
+			return errHandler
+		}
+
+		commands = append(commands, [2]string{sm.getCommandTopic(nodeID, mapping.topic), valueString})
+
+		offset += length
+	}
+
+	return sm.sendCommands(commands)
+}
+
+// decodeRegisterValue converts registers (in the same encoding as they are read) to string value for MQTT
+func decodeRegisterValue(logger Logger, mapping MappingTypeTable, regs []byte) (valueString string, errHandler ErrorHandler) {
+
+	// Get big endian copy of value (request buffer must stay untouched)
+	value := applyByteOrder(append([]byte(nil), regs...), mapping.byteOrder)
+
+	// Get value bits (in uint64) from registers
+	var valueBits uint64
+	for _, b := range value {
+		valueBits = valueBits<<8 | uint64(b)
+	}
+
+	// Raw value of scaled register is converted back to engineering value ((value - offset) / scale)
+	var valueFloat float64
+	switch mapping.valType {
+	case ValueTypeFLOAT:
+		valueFloat = float64(math.Float32frombits(uint32(valueBits)))
+		valueString = strconv.FormatFloat(valueFloat, 'f', -1, 32)
+	case ValueTypeFLOAT64:
+		valueFloat = math.Float64frombits(valueBits)
+		valueString = strconv.FormatFloat(valueFloat, 'f', -1, 64)
+	case ValueTypeINT16:
+		valueFloat = float64(int16(valueBits))
+		valueString = strconv.FormatInt(int64(int16(valueBits)), 10)
+	case ValueTypeSIGNED:
+		valueFloat = float64(int32(valueBits))
+		valueString = strconv.FormatInt(int64(int32(valueBits)), 10)
+	case ValueTypeINT64:
+		valueFloat = float64(int64(valueBits))
+		valueString = strconv.FormatInt(int64(valueBits), 10)
+	case ValueTypeUINT16, ValueTypeUNSIGNED, ValueTypeUINT64:
+		valueFloat = float64(valueBits)
+		valueString = strconv.FormatUint(valueBits, 10)
+	default:
+		logger.Warn("Unsupported value type for writing", F("value_type", mapping.valType))
+		errHandler.ExceptionCode = ExceptionCodeIllegalDataAddress
+		return "", errHandler
+	}
+
+	if mapping.isScaled() {
+		valueString = strconv.FormatFloat((valueFloat-mapping.offset)/mapping.scale, 'f', -1, 64)
+	}
+
+	return valueString, errHandler
+}
+
+// getCommandTopic creates MQTT topic for command from nodeID and topic (register)
+func (sm *smartMeter) getCommandTopic(nodeID string, topic string) string {
+	return strings.NewReplacer("{nodeID}", nodeID, "{topic}", topic).Replace(sm.commandTopic)
+}
+
+// sendCommands sends commands to MQTT publisher through command channel
+func (sm *smartMeter) sendCommands(commands [][2]string) (errHandler ErrorHandler) {
+
+	if sm.chanCommand == nil {
+		sm.logger.Warn("Command channel is not set, values can not be written")
+		errHandler.ExceptionCode = ExceptionCodeServerDeviceFailure
+		return errHandler
+	}
+
+	// Do not block modbus client if publisher is not able to handle commands, values of one request
+	// are written all or none, so there must be space for all of them (only smart meter sends to channel)
+	sm.commandMu.Lock()
+	defer sm.commandMu.Unlock()
+	if cap(sm.chanCommand)-len(sm.chanCommand) < len(commands) {
+		sm.logger.Warn("Command channel is full", F("commands", len(commands)))
+		errHandler.ExceptionCode = ExceptionCodeServerDeviceBusy
+		return errHandler
+	}
+
+	for _, command := range commands {
+		sm.logger.Debug("Sending command", F("topic", command[0]), F("value", command[1]))
+		sm.chanCommand <- command
+	}
+
+	return errHandler
 }
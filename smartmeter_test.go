@@ -0,0 +1,538 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Warnings of tested error paths are not interesting
+	SetDefaultLogger(NewLogger(io.Discard, LevelError))
+	os.Exit(m.Run())
+}
+
+// testConfig maps unit 1 ("Node1") to registers of all data blocks
+func testConfig() *ConfigJSON {
+	return &ConfigJSON{
+		Devices: []DeviceJSON{{UnitID: 1, NodeID: "Node1", Type: 0}},
+		Types: []TypeJSON{{Registers: []RegisterJSON{
+			{Address: 100, Topic: "volt1", ValueType: ValueTypeFLOAT},
+			{Address: 102, Topic: "volt2", ValueType: ValueTypeFLOAT},
+			{Address: 104, Topic: "count", ValueType: ValueTypeUINT16},
+			{Address: 200, Topic: "inp", ValueType: ValueTypeFLOAT, DataBlock: DataBlockInputRegisters},
+			{Address: 0, Topic: "relay", ValueType: ValueTypeBOOL, DataBlock: DataBlockCoils},
+			{Address: 1, Topic: "alarm", ValueType: ValueTypeBOOL, DataBlock: DataBlockCoils},
+			{Address: 5, Topic: "di", ValueType: ValueTypeBOOL, DataBlock: DataBlockDiscreteInputs},
+		}}},
+	}
+}
+
+func newTestSmartMeter(t *testing.T) SmartMeter {
+	t.Helper()
+	sm, err := NewSmartMeterFromConfig(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+// mbap builds modbus TCP ADU
+func mbap(tid uint16, unitID byte, pdu ...byte) []byte {
+	adu := []byte{byte(tid >> 8), byte(tid), 0, 0, 0, 0, unitID}
+	binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+	return append(adu, pdu...)
+}
+
+// exchange sends request and reads one response (ADU fits into one read on local connections), nil is returned after error
+func exchange(t *testing.T, c net.Conn, request []byte) []byte {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write(request); err != nil {
+		t.Error(err)
+		return nil
+	}
+	response := make([]byte, MaxADULength)
+	n, err := c.Read(response)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return response[:n]
+}
+
+// freePort finds free TCP port on localhost
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestServer starts TCP server on free port (setup functions are called before start), it is shut down at the end of test
+func startTestServer(t *testing.T, sm SmartMeter, setup ...func(s Server)) (Server, int) {
+	t.Helper()
+	port := freePort(t)
+	s := NewTCPServer(port, "127.0.0.1", sm)
+	for _, f := range setup {
+		f(s)
+	}
+	go s.ServerStart()
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+
+	// Wait for listener
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			c.Close()
+			return s, port
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return nil, 0
+}
+
+// checkWrittenFloat checks that float register value is one of values written by writers (not torn)
+func checkWrittenFloat(t *testing.T, regs []byte, max int) {
+	t.Helper()
+	value := math.Float32frombits(binary.BigEndian.Uint32(regs))
+	if value != float32(int(value)) || value < 0 || int(value) >= max {
+		t.Errorf("unexpected value %v", value)
+	}
+}
+
+func TestValueStoreConcurrent(t *testing.T) {
+	vs := newValueStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				vs.Store("Node1/topic"+strconv.Itoa(i%10), strconv.Itoa(w))
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if value, _, flag := vs.Load("Node1/topic" + strconv.Itoa(i%10)); flag && (value < "0" || value > "3") {
+					t.Errorf("unexpected value %q", value)
+				}
+				vs.Ages()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ages := vs.Ages(); len(ages) != 10 {
+		t.Errorf("ages of %d values, want 10", len(ages))
+	}
+}
+
+func TestSmartMeterConcurrentReadersWriters(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/volt1", "0")
+	sm.WriteValues("Node1/volt2", "0")
+
+	const values = 300
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < values; i++ {
+				sm.WriteValues("Node1/volt1", strconv.Itoa(i))
+				sm.WriteValues("Node1/volt2", strconv.Itoa(i))
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < values; i++ {
+				regs, errHandler := sm.GetRHRegisterValue([]byte{0, 100, 0, 4}, 1)
+				if errHandler.ExceptionCode != ExceptionCodeSuccess {
+					t.Errorf("exception %d", errHandler.ExceptionCode)
+					return
+				}
+				checkWrittenFloat(t, regs[0:4], values)
+				checkWrittenFloat(t, regs[4:8], values)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerConcurrentClientsAndPublishers(t *testing.T) {
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/volt1", "0")
+	_, port := startTestServer(t, sm)
+
+	const values = 200
+	done := make(chan struct{})
+	var publishers sync.WaitGroup
+	for p := 0; p < 2; p++ {
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			for i := 0; ; i = (i + 1) % values {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				sm.WriteValues("Node1/volt1", strconv.Itoa(i))
+			}
+		}()
+	}
+
+	var clients sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		clients.Add(1)
+		go func(c int) {
+			defer clients.Done()
+			conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			for i := 0; i < 50; i++ {
+				tid := uint16(c*100 + i)
+				response := exchange(t, conn, mbap(tid, 1, FuncCodeReadHoldingRegisters, 0, 100, 0, 2))
+				if len(response) != 13 || binary.BigEndian.Uint16(response) != tid {
+					t.Errorf("unexpected response % X", response)
+					return
+				}
+				checkWrittenFloat(t, response[9:13], values)
+			}
+		}(c)
+	}
+	clients.Wait()
+	close(done)
+	publishers.Wait()
+}
+
+func TestSmartMeterLogger(t *testing.T) {
+	var defaultLog, smLog bytes.Buffer
+	SetDefaultLogger(NewLogger(&defaultLog, LevelDebug))
+	defer SetDefaultLogger(NewLogger(io.Discard, LevelError))
+
+	sm := newTestSmartMeter(t)
+	sm.SetLogger(NewLogger(&smLog, LevelWarn))
+	sm.WriteValues("Node1/count", "not a number")
+
+	if _, errHandler := sm.GetRHRegisterValue([]byte{0, 104, 0, 1}, 1); errHandler.ExceptionCode == ExceptionCodeSuccess {
+		t.Error("invalid value encoded")
+	}
+	if !strings.Contains(smLog.String(), "Parsing value was not succesfull") {
+		t.Errorf("warning is not logged by smart meter logger: %q", smLog.String())
+	}
+	if defaultLog.Len() != 0 {
+		t.Errorf("default logger used: %q", defaultLog.String())
+	}
+}
+
+func TestSmartMeterAddressRange(t *testing.T) {
+	// Values at first and last address, block over address 65535 must not wrap to address 0
+	sm, err := NewSmartMeterFromConfig(&ConfigJSON{
+		Devices: []DeviceJSON{{UnitID: 1, NodeID: "Node1", Type: 0}},
+		Types: []TypeJSON{{Registers: []RegisterJSON{
+			{Address: 0, Topic: "first", ValueType: ValueTypeUINT16},
+			{Address: 65535, Topic: "last", ValueType: ValueTypeUINT16},
+			{Address: 0, Topic: "firstCoil", ValueType: ValueTypeBOOL, DataBlock: DataBlockCoils},
+			{Address: 65535, Topic: "lastCoil", ValueType: ValueTypeBOOL, DataBlock: DataBlockCoils},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.WriteValues("Node1/first", "7")
+	sm.WriteValues("Node1/last", "9")
+	sm.WriteValues("Node1/firstCoil", "1")
+	sm.WriteValues("Node1/lastCoil", "1")
+	sm.SetCommandChannel(make(chan [2]string, 8))
+
+	readRegisters := func(data []byte) ErrorHandler {
+		_, errHandler := sm.GetRHRegisterValue(data, 1)
+		return errHandler
+	}
+	readCoils := func(data []byte) ErrorHandler {
+		_, errHandler := sm.GetCoilsValue(data, 1)
+		return errHandler
+	}
+	tests := []struct {
+		name          string
+		request       func() ErrorHandler
+		exceptionCode byte
+	}{
+		{"last register", func() ErrorHandler { return readRegisters([]byte{0xFF, 0xFF, 0, 1}) }, ExceptionCodeSuccess},
+		{"over last register", func() ErrorHandler { return readRegisters([]byte{0xFF, 0xFF, 0, 2}) }, ExceptionCodeIllegalDataAddress},
+		{"max quantity over last register", func() ErrorHandler { return readRegisters([]byte{0xFF, 0x90, 0, 125}) }, ExceptionCodeIllegalDataAddress},
+		{"last coil", func() ErrorHandler { return readCoils([]byte{0xFF, 0xFF, 0, 1}) }, ExceptionCodeSuccess},
+		{"over last coil", func() ErrorHandler { return readCoils([]byte{0xFF, 0xFF, 0, 2}) }, ExceptionCodeIllegalDataAddress},
+		{"write last coil", func() ErrorHandler { return sm.WriteCoilsValue(1, 0xFFFF, []bool{true}) }, ExceptionCodeSuccess},
+		{"write over last coil", func() ErrorHandler { return sm.WriteCoilsValue(1, 0xFFFF, []bool{true, true}) }, ExceptionCodeIllegalDataAddress},
+		{"write last register", func() ErrorHandler { return sm.WriteRHRegistersValue(1, 0xFFFF, []byte{0, 1}) }, ExceptionCodeSuccess},
+		{"write over last register", func() ErrorHandler { return sm.WriteRHRegistersValue(1, 0xFFFF, []byte{0, 1, 0, 2}) }, ExceptionCodeIllegalDataAddress},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errHandler := test.request(); errHandler.ExceptionCode != test.exceptionCode {
+				t.Errorf("exception code %d, want %d", errHandler.ExceptionCode, test.exceptionCode)
+			}
+		})
+	}
+}
+
+// testMapping creates mapping of register without scaling
+func testMapping(valueType int, byteOrder int) MappingTypeTable {
+	return MappingTypeTable{topic: "value", valType: valueType, byteOrder: byteOrder, scale: 1}
+}
+
+func TestEncodeRegisterValueByteOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		valueType int
+		value     string
+		byteOrder int
+		regs      []byte
+	}{
+		{"uint16 ABCD", ValueTypeUINT16, "4386", ByteOrderABCD, []byte{0x11, 0x22}},
+		{"uint16 DCBA", ValueTypeUINT16, "4386", ByteOrderDCBA, []byte{0x22, 0x11}},
+		{"uint16 BADC", ValueTypeUINT16, "4386", ByteOrderBADC, []byte{0x22, 0x11}},
+		{"uint16 CDAB", ValueTypeUINT16, "4386", ByteOrderCDAB, []byte{0x11, 0x22}},
+		{"uint32 ABCD", ValueTypeUINT32, "287454020", ByteOrderABCD, []byte{0x11, 0x22, 0x33, 0x44}},
+		{"uint32 DCBA", ValueTypeUINT32, "287454020", ByteOrderDCBA, []byte{0x44, 0x33, 0x22, 0x11}},
+		{"uint32 BADC", ValueTypeUINT32, "287454020", ByteOrderBADC, []byte{0x22, 0x11, 0x44, 0x33}},
+		{"uint32 CDAB", ValueTypeUINT32, "287454020", ByteOrderCDAB, []byte{0x33, 0x44, 0x11, 0x22}},
+		{"float ABCD", ValueTypeFLOAT, "1.5", ByteOrderABCD, []byte{0x3F, 0xC0, 0x00, 0x00}},
+		{"float DCBA", ValueTypeFLOAT, "1.5", ByteOrderDCBA, []byte{0x00, 0x00, 0xC0, 0x3F}},
+		{"float BADC", ValueTypeFLOAT, "1.5", ByteOrderBADC, []byte{0xC0, 0x3F, 0x00, 0x00}},
+		{"float CDAB", ValueTypeFLOAT, "1.5", ByteOrderCDAB, []byte{0x00, 0x00, 0x3F, 0xC0}},
+		{"uint64 ABCD", ValueTypeUINT64, "1234605616436508552", ByteOrderABCD, []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}},
+		{"uint64 DCBA", ValueTypeUINT64, "1234605616436508552", ByteOrderDCBA, []byte{0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}},
+		{"uint64 BADC", ValueTypeUINT64, "1234605616436508552", ByteOrderBADC, []byte{0x22, 0x11, 0x44, 0x33, 0x66, 0x55, 0x88, 0x77}},
+		{"uint64 CDAB", ValueTypeUINT64, "1234605616436508552", ByteOrderCDAB, []byte{0x77, 0x88, 0x55, 0x66, 0x33, 0x44, 0x11, 0x22}},
+		{"float64 CDAB", ValueTypeFLOAT64, "1.5", ByteOrderCDAB, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3F, 0xF8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping := testMapping(test.valueType, test.byteOrder)
+			regs, errHandler := encodeRegisterValue(defaultLogger, mapping, test.value)
+			if errHandler.ExceptionCode != ExceptionCodeSuccess {
+				t.Fatalf("exception code %d", errHandler.ExceptionCode)
+			}
+			if !bytes.Equal(regs, test.regs) {
+				t.Errorf("registers % X, want % X", regs, test.regs)
+			}
+
+			// Written registers are decoded in the same byte order
+			value, errHandler := decodeRegisterValue(defaultLogger, mapping, test.regs)
+			if errHandler.ExceptionCode != ExceptionCodeSuccess || value != test.value {
+				t.Errorf("decoded value %q (exception code %d), want %q", value, errHandler.ExceptionCode, test.value)
+			}
+		})
+	}
+}
+
+func TestApplyByteOrderReverse(t *testing.T) {
+	for _, byteOrder := range []int{ByteOrderABCD, ByteOrderDCBA, ByteOrderBADC, ByteOrderCDAB} {
+		for _, length := range []int{2, 4, 8} {
+			value := []byte{1, 2, 3, 4, 5, 6, 7, 8}[:length]
+			reordered := applyByteOrder(append([]byte(nil), value...), byteOrder)
+			if back := applyByteOrder(reordered, byteOrder); !bytes.Equal(back, value) {
+				t.Errorf("byte order %d, length %d: % X reordered back to % X", byteOrder, length, value, back)
+			}
+		}
+	}
+}
+
+func TestEncodeRegisterValueTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		valueType     int
+		value         string
+		regs          []byte
+		exceptionCode byte
+	}{
+		{"int16 negative", ValueTypeINT16, "-1", []byte{0xFF, 0xFF}, ExceptionCodeSuccess},
+		{"int16 max", ValueTypeINT16, "32767", []byte{0x7F, 0xFF}, ExceptionCodeSuccess},
+		{"int16 min", ValueTypeINT16, "-32768", []byte{0x80, 0x00}, ExceptionCodeSuccess},
+		{"int16 overflow", ValueTypeINT16, "32768", nil, ExceptionCodeValueOverflow},
+		{"uint16 max", ValueTypeUINT16, "65535", []byte{0xFF, 0xFF}, ExceptionCodeSuccess},
+		{"uint16 overflow", ValueTypeUINT16, "65536", nil, ExceptionCodeValueOverflow},
+		{"uint16 negative", ValueTypeUINT16, "-1", nil, ExceptionCodeCreationError},
+		{"int32 negative", ValueTypeINT32, "-2", []byte{0xFF, 0xFF, 0xFF, 0xFE}, ExceptionCodeSuccess},
+		{"int32 overflow", ValueTypeINT32, "2147483648", nil, ExceptionCodeValueOverflow},
+		{"uint32 max", ValueTypeUINT32, "4294967295", []byte{0xFF, 0xFF, 0xFF, 0xFF}, ExceptionCodeSuccess},
+		{"uint32 overflow", ValueTypeUINT32, "4294967296", nil, ExceptionCodeValueOverflow},
+		{"int64 negative", ValueTypeINT64, "-1", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, ExceptionCodeSuccess},
+		{"int64 min", ValueTypeINT64, "-9223372036854775808", []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, ExceptionCodeSuccess},
+		{"uint64 max", ValueTypeUINT64, "18446744073709551615", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, ExceptionCodeSuccess},
+		{"uint64 overflow", ValueTypeUINT64, "18446744073709551616", nil, ExceptionCodeValueOverflow},
+		{"float", ValueTypeFLOAT, "-2.5", []byte{0xC0, 0x20, 0x00, 0x00}, ExceptionCodeSuccess},
+		{"float overflow", ValueTypeFLOAT, "1e39", nil, ExceptionCodeValueOverflow},
+		{"float64", ValueTypeFLOAT64, "-2.5", []byte{0xC0, 0x04, 0, 0, 0, 0, 0, 0}, ExceptionCodeSuccess},
+		{"integer with fraction", ValueTypeINT32, "1.5", nil, ExceptionCodeCreationError},
+		{"not a number", ValueTypeUINT16, "abc", nil, ExceptionCodeCreationError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping := testMapping(test.valueType, ByteOrderABCD)
+			regs, errHandler := encodeRegisterValue(defaultLogger, mapping, test.value)
+			if errHandler.ExceptionCode != test.exceptionCode {
+				t.Fatalf("exception code %X, want %X", errHandler.ExceptionCode, test.exceptionCode)
+			}
+			if !bytes.Equal(regs, test.regs) {
+				t.Errorf("registers % X, want % X", regs, test.regs)
+			}
+			if test.exceptionCode != ExceptionCodeSuccess {
+				return
+			}
+			if length := valueTypeLength(test.valueType); int(length)*2 != len(regs) {
+				t.Errorf("value type length %d, encoded %d bytes", length, len(regs))
+			}
+
+			// Written registers are decoded to the same value
+			value, errHandler := decodeRegisterValue(defaultLogger, mapping, regs)
+			if errHandler.ExceptionCode != ExceptionCodeSuccess || value != test.value {
+				t.Errorf("decoded value %q (exception code %d), want %q", value, errHandler.ExceptionCode, test.value)
+			}
+		})
+	}
+}
+
+func TestEncodeRegisterValueScaling(t *testing.T) {
+	limit := func(value float64) *float64 {
+		return &value
+	}
+
+	tests := []struct {
+		name          string
+		mapping       MappingTypeTable
+		value         string
+		regs          []byte
+		exceptionCode byte
+		// Value decoded from registers (written by client), empty if it is the same as value
+		decoded string
+	}{
+		{"scale", MappingTypeTable{valType: ValueTypeINT16, scale: 100}, "230.41", []byte{0x5A, 0x01}, ExceptionCodeSuccess, ""},
+		{"scale and offset", MappingTypeTable{valType: ValueTypeUINT16, scale: 10, offset: -5}, "1", []byte{0x00, 0x05}, ExceptionCodeSuccess, ""},
+		{"rounding", MappingTypeTable{valType: ValueTypeINT16, scale: 10}, "1.26", []byte{0x00, 0x0D}, ExceptionCodeSuccess, "1.3"},
+		{"negative", MappingTypeTable{valType: ValueTypeINT32, scale: 1000}, "-1.5", []byte{0xFF, 0xFF, 0xFA, 0x24}, ExceptionCodeSuccess, ""},
+		{"clamped to min", MappingTypeTable{valType: ValueTypeUINT16, scale: 1, min: limit(0)}, "-3", []byte{0x00, 0x00}, ExceptionCodeSuccess, "0"},
+		{"clamped to max", MappingTypeTable{valType: ValueTypeUINT16, scale: 1, max: limit(100)}, "250", []byte{0x00, 0x64}, ExceptionCodeSuccess, "100"},
+		{"within limits", MappingTypeTable{valType: ValueTypeUINT16, scale: 1, min: limit(0), max: limit(100)}, "42", []byte{0x00, 0x2A}, ExceptionCodeSuccess, ""},
+		{"float", MappingTypeTable{valType: ValueTypeFLOAT, scale: 2}, "1.5", []byte{0x40, 0x40, 0x00, 0x00}, ExceptionCodeSuccess, ""},
+		{"byte order", MappingTypeTable{valType: ValueTypeUINT32, scale: 100, byteOrder: ByteOrderCDAB}, "700", []byte{0x11, 0x70, 0x00, 0x01}, ExceptionCodeSuccess, ""},
+		{"int16 overflow", MappingTypeTable{valType: ValueTypeINT16, scale: 1000}, "40", nil, ExceptionCodeValueOverflow, ""},
+		{"uint16 negative", MappingTypeTable{valType: ValueTypeUINT16, scale: 2}, "-1", nil, ExceptionCodeValueOverflow, ""},
+		{"float overflow", MappingTypeTable{valType: ValueTypeFLOAT, scale: 10}, "1e38", nil, ExceptionCodeValueOverflow, ""},
+		{"not a number", MappingTypeTable{valType: ValueTypeINT16, scale: 10}, "abc", nil, ExceptionCodeCreationError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			regs, errHandler := encodeRegisterValue(defaultLogger, test.mapping, test.value)
+			if errHandler.ExceptionCode != test.exceptionCode {
+				t.Fatalf("exception code %X, want %X", errHandler.ExceptionCode, test.exceptionCode)
+			}
+			if !bytes.Equal(regs, test.regs) {
+				t.Errorf("registers % X, want % X", regs, test.regs)
+			}
+			if test.exceptionCode != ExceptionCodeSuccess {
+				return
+			}
+
+			// Written registers are converted back to engineering value
+			decoded := test.decoded
+			if decoded == "" {
+				decoded = test.value
+			}
+			value, errHandler := decodeRegisterValue(defaultLogger, test.mapping, regs)
+			if errHandler.ExceptionCode != ExceptionCodeSuccess || value != decoded {
+				t.Errorf("decoded value %q (exception code %d), want %q", value, errHandler.ExceptionCode, decoded)
+			}
+		})
+	}
+}
+
+func TestLoadValueStale(t *testing.T) {
+	sentinel := "0"
+
+	tests := []struct {
+		name               string
+		staleExceptionCode int
+		staleValue         *string
+		unitMaxAge         time.Duration
+		registerMaxAge     time.Duration
+		store              bool
+		regs               []byte
+		exceptionCode      byte
+		quality            int
+	}{
+		{"missing", 0, nil, time.Hour, 0, false, nil, ExceptionCodeGatewayTargetDeviceFailedToRespond, ValueQualityMissing},
+		{"fresh", 0, nil, time.Hour, 0, true, []byte{0x00, 0x07}, ExceptionCodeSuccess, ValueQualityGood},
+		{"no max age", 0, nil, 0, 0, true, []byte{0x00, 0x07}, ExceptionCodeSuccess, ValueQualityGood},
+		{"stale", 0, nil, time.Nanosecond, 0, true, nil, ExceptionCodeGatewayTargetDeviceFailedToRespond, ValueQualityStale},
+		{"stale exception code", ExceptionCodeServerDeviceFailure, nil, time.Nanosecond, 0, true, nil, ExceptionCodeServerDeviceFailure, ValueQualityStale},
+		{"stale sentinel", 0, &sentinel, time.Nanosecond, 0, true, []byte{0x00, 0x00}, ExceptionCodeSuccess, ValueQualityStale},
+		{"register max age overrides unit", 0, nil, time.Nanosecond, time.Hour, true, []byte{0x00, 0x07}, ExceptionCodeSuccess, ValueQualityGood},
+		{"register max age stale", 0, nil, time.Hour, time.Nanosecond, true, nil, ExceptionCodeGatewayTargetDeviceFailedToRespond, ValueQualityStale},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.StaleExceptionCode = test.staleExceptionCode
+			cfg.StaleValue = test.staleValue
+			sm := newSmartMeter(cfg)
+			sm.mappUnitTable[1] = MappingUnitTable{nodeID: "Node1", maxAge: test.unitMaxAge}
+			mapping := sm.smTypes[0].mType[DataBlockHoldingRegisters][104]
+			mapping.maxAge = test.registerMaxAge
+			sm.smTypes[0].mType[DataBlockHoldingRegisters][104] = mapping
+
+			if test.store {
+				sm.smValues.Store("Node1/count", "7")
+				time.Sleep(time.Millisecond)
+			}
+
+			regs, errHandler := sm.GetRHRegisterValue([]byte{0, 104, 0, 1}, 1)
+			if errHandler.ExceptionCode != test.exceptionCode {
+				t.Fatalf("exception code %d, want %d", errHandler.ExceptionCode, test.exceptionCode)
+			}
+			if !bytes.Equal(regs, test.regs) {
+				t.Errorf("registers % X, want % X", regs, test.regs)
+			}
+
+			age, quality, errHandler := sm.GetValueAge(1, DataBlockHoldingRegisters, 104)
+			if errHandler.ExceptionCode != ExceptionCodeSuccess || quality != test.quality {
+				t.Errorf("quality %d (exception code %d), want %d", quality, errHandler.ExceptionCode, test.quality)
+			}
+			if test.store == (age == 0) {
+				t.Errorf("unexpected age %v", age)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+)
+
+// storedValue is value with time when it was received
+type storedValue struct {
+	value    string
+	received time.Time
+}
+
+// valueStore is storage for smart meter values (map["nodeID/topic"] = value with receive time),
+// it is safe for concurrent access of many readers (modbus clients) and writers (MQTT bridges)
+type valueStore struct {
+	mutex  sync.RWMutex
+	values map[string]storedValue
+}
+
+// newValueStore creates empty value store
+func newValueStore() *valueStore {
+	return &valueStore{values: make(map[string]storedValue)}
+}
+
+// Load gets stored value for key and time when it was received, flag is false if value is not present
+func (vs *valueStore) Load(key string) (value string, received time.Time, flag bool) {
+	vs.mutex.RLock()
+	stored, flag := vs.values[key]
+	vs.mutex.RUnlock()
+	return stored.value, stored.received, flag
+}
+
+// Store sets value for key, receive time is now
+func (vs *valueStore) Store(key string, value string) {
+	vs.mutex.Lock()
+	vs.values[key] = storedValue{value: value, received: time.Now()}
+	vs.mutex.Unlock()
+}
+
+// Ages gets age of all stored values
+func (vs *valueStore) Ages() map[string]time.Duration {
+	now := time.Now()
+
+	vs.mutex.RLock()
+	defer vs.mutex.RUnlock()
+
+	ages := make(map[string]time.Duration, len(vs.values))
+	for key, stored := range vs.values {
+		ages[key] = now.Sub(stored.received)
+	}
+	return ages
+}
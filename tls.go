@@ -0,0 +1,185 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+)
+
+// DefaultTLSPort for modbus/TCP security
+const DefaultTLSPort = 802
+
+// RoleOID is X.509 extension with role of client (ASN.1 UTF8String), see modbus/TCP security specification
+var RoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// TLSConfig for modbus/TCP security server
+type TLSConfig struct {
+	// Port for listening (DefaultTLSPort if it is 0)
+	Port int
+	// Server certificate and its key (PEM files)
+	CertFile string
+	KeyFile  string
+	// CA for verification of client certificates (PEM file)
+	CAFile string
+	// Permissions for roles of clients (see @RoleOID), if it is empty every verified client can do everything
+	Roles map[string]RolePermissions
+}
+
+// RolePermissions specifies unit IDs and function codes allowed for role, empty array allows all
+type RolePermissions struct {
+	UnitIDs       []int
+	FunctionCodes []int
+}
+
+// LoadTLSRoles reads permissions of roles from "TLSRoles" object in config file, see @conf.json.comment
+func LoadTLSRoles(config string) (roles map[string]RolePermissions, err error) {
+
+	file, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mapp struct {
+		TLSRoles map[string]RolePermissions
+	}
+	if err = json.NewDecoder(file).Decode(&mapp); err != nil {
+		return nil, err
+	}
+
+	return mapp.TLSRoles, nil
+}
+
+// ServerStartTLS starts modbus/TCP security server (TLS 1.2+, client certificate is required and verified against CA)
+func (s *server) ServerStartTLS(config TLSConfig) (err error) {
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		s.logger.Error("Not possible to load server certificate", F("error", err))
+		return err
+	}
+
+	caPEM, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		s.logger.Error("Not possible to load CA certificate", F("error", err))
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		s.logger.Error("Not possible to parse CA certificate")
+		return errors.New("modbus: invalid CA certificate")
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = DefaultTLSPort
+	}
+
+	s.roles = config.Roles
+
+	// Create server
+	ln, err := tls.Listen("tcp", s.addr+":"+strconv.Itoa(port), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	// Check if it was succesufully created
+	if err != nil {
+		s.logger.Error("Not possible to create TLS server", F("error", err))
+		return err
+	}
+	if !s.addListener(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(ln)
+
+	// Run it
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			s.logger.Warn("Accept error", F("error", err))
+			continue
+		}
+
+		s.logger.Debug("Handle TLS request")
+		// Asynchronously handle request, TLS handshake is done by first read
+		go s.HandleClient(conn)
+	}
+}
+
+// authorize checks if role of TLS client allows request, other connections are not restricted
+func (s *server) authorize(c net.Conn, aduUnit *ADUUnit) (errHandler ErrorHandler) {
+
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok || len(s.roles) == 0 {
+		return errHandler
+	}
+
+	// Authorization failure is reported as IllegalFunction exception (see modbus/TCP security specification)
+	errHandler.FunctionCode = aduUnit.functionCode
+	errHandler.ExceptionCode = ExceptionCodeIllegalFunction
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		s.logger.Warn("Client certificate is missing")
+		return errHandler
+	}
+
+	role, flag := s.roleFromCertificate(state.PeerCertificates[0])
+	if flag == false {
+		s.logger.Warn("Client certificate has no role")
+		return errHandler
+	}
+
+	permissions, flag := s.roles[role]
+	if flag == false {
+		s.logger.Warn("Unknown role of client", F("role", role), F("remote", c.RemoteAddr()))
+		return errHandler
+	}
+
+	if !containsInt(permissions.UnitIDs, int(aduUnit.unitID)) || !containsInt(permissions.FunctionCodes, int(aduUnit.functionCode)) {
+		s.logger.Warn("Role is not allowed to use unit ID and function code", F("role", role), F("remote", c.RemoteAddr()), F("unit", aduUnit.unitID), F("fc", aduUnit.functionCode))
+		return errHandler
+	}
+
+	return ErrorHandler{}
+}
+
+// roleFromCertificate gets role from certificate extension, see @RoleOID
+func (s *server) roleFromCertificate(cert *x509.Certificate) (role string, flag bool) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(RoleOID) {
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &role, "utf8"); err != nil {
+				s.logger.Warn("Invalid role in client certificate", F("error", err))
+				return "", false
+			}
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// containsInt checks if array includes value, empty array includes everything
+func containsInt(array []int, value int) bool {
+	if len(array) == 0 {
+		return true
+	}
+	for _, item := range array {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
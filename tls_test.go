@@ -0,0 +1,257 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates of server and clients
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates certificate signed by ca (self-signed CA if ca is nil), role is put to RoleOID extension if it is not empty
+func newTestCertificate(t *testing.T, ca *testCA, name string, role string) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if role != "" {
+		value, err := asn1.MarshalWithParams(role, "utf8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: RoleOID, Value: value}}
+	}
+
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	cert, key := newTestCertificate(t, nil, name, "")
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes certificate and key (if it is not nil) to PEM files in dir
+func writePEM(t *testing.T, dir string, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCertificate converts certificate and key to form used by TLS client
+func clientCertificate(cert *x509.Certificate, key *ecdsa.PrivateKey) []tls.Certificate {
+	return []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}}
+}
+
+// startTestTLSServer starts TLS server with certificates signed by ca, it is shut down at the end of test
+func startTestTLSServer(t *testing.T, ca *testCA, roles map[string]RolePermissions) (addr string, chanCommand chan [2]string) {
+	t.Helper()
+	dir := t.TempDir()
+	serverCert, serverKey := newTestCertificate(t, ca, "server", "")
+	writePEM(t, dir, "ca", ca.cert, nil)
+	writePEM(t, dir, "server", serverCert, serverKey)
+
+	sm := newTestSmartMeter(t)
+	sm.WriteValues("Node1/relay", "1")
+	sm.WriteValues("Node1/volt1", "230")
+	chanCommand = make(chan [2]string, 8)
+	sm.SetCommandChannel(chanCommand)
+
+	port := freePort(t)
+	s := NewTCPServer(0, "127.0.0.1", sm)
+	go s.ServerStartTLS(TLSConfig{
+		Port:     port,
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Roles:    roles,
+	})
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+
+	// Wait for listener
+	addr = "127.0.0.1:" + strconv.Itoa(port)
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return addr, chanCommand
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return "", nil
+}
+
+// tlsExchange connects with certificates, sends request and returns response, err is set if handshake or exchange failed
+func tlsExchange(addr string, roots *x509.CertPool, certificates []tls.Certificate, request []byte) (response []byte, err error) {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, &tls.Config{RootCAs: roots, Certificates: certificates})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// With TLS 1.3 client certificate is verified after client handshake is completed, failure is reported by read
+	if _, err = c.Write(request); err != nil {
+		return nil, err
+	}
+	response = make([]byte, MaxADULength)
+	n, err := c.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+func TestTLSClientCertificateRequired(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	addr, _ := startTestTLSServer(t, ca, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	otherCA := newTestCA(t, "other ca")
+	request := mbap(1, 1, FuncCodeReadHoldingRegisters, 0, 100, 0, 2)
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		fail         bool
+	}{
+		{"without certificate", nil, true},
+		{"certificate of other CA", clientCertificate(newTestCertificate(t, otherCA, "client", "operator")), true},
+		{"certificate without role", clientCertificate(newTestCertificate(t, ca, "client", "")), false},
+		{"certificate with role", clientCertificate(newTestCertificate(t, ca, "client", "operator")), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := tlsExchange(addr, roots, test.certificates, request)
+			if test.fail {
+				if err == nil {
+					t.Errorf("request accepted, response % X", response)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Without roles every verified client can do everything
+			if want := mbap(1, 1, FuncCodeReadHoldingRegisters, 4, 0x43, 0x66, 0, 0); !bytes.Equal(response, want) {
+				t.Errorf("response % X, want % X", response, want)
+			}
+		})
+	}
+}
+
+func TestTLSRolePermissions(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	addr, chanCommand := startTestTLSServer(t, ca, map[string]RolePermissions{
+		"viewer":   {UnitIDs: []int{1}, FunctionCodes: []int{FuncCodeReadCoils, FuncCodeReadHoldingRegisters}},
+		"operator": {},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	viewer := clientCertificate(newTestCertificate(t, ca, "viewer", "viewer"))
+	operator := clientCertificate(newTestCertificate(t, ca, "operator", "operator"))
+	unknown := clientCertificate(newTestCertificate(t, ca, "guest", "guest"))
+	noRole := clientCertificate(newTestCertificate(t, ca, "anonymous", ""))
+
+	readCoils := []byte{FuncCodeReadCoils, 0, 0, 0, 1}
+	writeCoil := []byte{FuncCodeWriteSingleCoil, 0, 1, 0xFF, 0}
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		unitID       byte
+		pdu          []byte
+		want         []byte
+		command      bool
+	}{
+		{"viewer reads", viewer, 1, readCoils, []byte{FuncCodeReadCoils, 1, 1}, false},
+		{"viewer writes", viewer, 1, writeCoil, []byte{FuncCodeWriteSingleCoil | 0x80, ExceptionCodeIllegalFunction}, false},
+		{"viewer reads other unit", viewer, 2, readCoils, []byte{FuncCodeReadCoils | 0x80, ExceptionCodeIllegalFunction}, false},
+		{"operator writes", operator, 1, writeCoil, writeCoil, true},
+		{"unknown role", unknown, 1, readCoils, []byte{FuncCodeReadCoils | 0x80, ExceptionCodeIllegalFunction}, false},
+		{"certificate without role", noRole, 1, readCoils, []byte{FuncCodeReadCoils | 0x80, ExceptionCodeIllegalFunction}, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tid := uint16(i + 1)
+			response, err := tlsExchange(addr, roots, test.certificates, mbap(tid, test.unitID, test.pdu...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mbap(tid, test.unitID, test.want...); !bytes.Equal(response, want) {
+				t.Errorf("response % X, want % X", response, want)
+			}
+			if commands := len(chanCommand); commands != 0 != test.command {
+				t.Errorf("%d commands sent", commands)
+			}
+			for len(chanCommand) > 0 {
+				<-chanCommand
+			}
+		})
+	}
+}
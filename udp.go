@@ -0,0 +1,96 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+// udpConn is connection for one received datagram (request), response is sent back to sender, implements net.Conn interface
+type udpConn struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	request *bytes.Reader
+}
+
+func (c *udpConn) Read(b []byte) (n int, err error) {
+	return c.request.Read(b)
+}
+
+func (c *udpConn) Write(b []byte) (n int, err error) {
+	return c.pc.WriteTo(b, c.addr)
+}
+
+func (c *udpConn) Close() error {
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// ServerStartUDP starts modbus UDP server on the same address and port as TCP server, each datagram is one ADU (MBAP + PDU)
+func (s *server) ServerStartUDP() (err error) {
+
+	// Create server
+	p := strconv.Itoa(s.port)
+	pc, err := net.ListenPacket("udp", s.addr+":"+p)
+
+	// Check if it was succesufully created
+	if err != nil {
+		s.logger.Error("Not possible to create UDP server", F("error", err))
+		return err
+	}
+	defer pc.Close()
+	if !s.addListener(pc) {
+		return ErrServerClosed
+	}
+	defer s.removeListener(pc)
+
+	// One more byte to find out too long datagrams
+	data := make([]byte, MaxADULength+1)
+	for {
+		n, addr, err := pc.ReadFrom(data)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			s.logger.Error("UDP read error", F("error", err))
+			return err
+		}
+
+		if n > MaxADULength {
+			s.logger.Warn("Dropping UDP datagram longer than max ADU length", F("remote", addr))
+			continue
+		}
+
+		s.logger.Debug("Handle UDP request", F("remote", addr))
+
+		// Asynchronously handle request, datagram is copied because buffer is reused
+		c := &udpConn{pc: pc, addr: addr, request: bytes.NewReader(append([]byte(nil), data[:n]...))}
+		if err = s.addHandler(nil); err != nil {
+			return err
+		}
+		go func() {
+			defer s.removeHandler(nil)
+			s.Read(c, NewMBAPFramer(c))
+		}()
+	}
+}